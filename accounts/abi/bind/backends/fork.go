@@ -0,0 +1,183 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package backends
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/internal/ethapi"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+// forkGasLimit is the block gas limit of the local chain of a forked backend
+const forkGasLimit = 8000000
+
+// NewForkedSimulatedBackend creates a simulated backend whose state is backed by the
+// state of a remote archive node as of the block forkBlock. Accounts, storage and
+// code that the backend does not have locally are fetched from the archive with
+// eth_getProof, eth_getStorageAt and eth_getCode when they are first read, and are
+// cached afterwards. The remote state is only visible to the reads and calls against
+// the committed state (CallContract, BalanceAt, StorageAt, etc.). Transactions are
+// executed against the local state only, because the imported blocks are verified
+// by re-executing them on the local chain. If config is nil, all the protocol
+// changes are enabled.
+func NewForkedSimulatedBackend(archiveClient *rpc.Client, forkBlock uint64, config *params.ChainConfig) *SimulatedBackend {
+	if config == nil {
+		config = params.AllEthashProtocolChanges
+	}
+	backend := newSimulatedBackend(core.GenesisAlloc{}, forkGasLimit, config)
+	backend.fork = &forkCache{
+		archive:   archiveClient,
+		forkBlock: hexutil.EncodeUint64(forkBlock),
+		accounts:  make(map[common.Address]*state.Account),
+		storage:   make(map[common.Address]map[common.Hash][]byte),
+		code:      make(map[common.Hash][]byte),
+	}
+	return backend
+}
+
+// forkCache holds the state fetched from the archive node of a forked backend
+type forkCache struct {
+	archive   *rpc.Client
+	forkBlock string // Number of the fork block, as passed to the archive
+
+	mu       sync.Mutex
+	accounts map[common.Address]*state.Account // Fetched accounts, nil for accounts that do not exist
+	storage  map[common.Address]map[common.Hash][]byte
+	code     map[common.Hash][]byte
+}
+
+// account returns the account as of the fork block, fetching it from the archive
+// if it has not been fetched before. The code of the account is fetched together
+// with it.
+func (fc *forkCache) account(address common.Address) (*state.Account, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if account, ok := fc.accounts[address]; ok {
+		return account, nil
+	}
+	var result ethapi.AccountResult
+	if err := fc.archive.CallContext(context.Background(), &result, "eth_getProof", address, []string{}, fc.forkBlock); err != nil {
+		return nil, err
+	}
+	balance := new(big.Int)
+	if result.Balance != nil {
+		balance = result.Balance.ToInt()
+	}
+	var account *state.Account
+	if result.Nonce != 0 || balance.Sign() != 0 || result.CodeHash != emptyCodeHash {
+		account = &state.Account{
+			Nonce:    uint64(result.Nonce),
+			Balance:  balance,
+			Root:     result.StorageHash,
+			CodeHash: result.CodeHash[:],
+		}
+	}
+	if account != nil && result.CodeHash != emptyCodeHash {
+		if _, ok := fc.code[result.CodeHash]; !ok {
+			var code hexutil.Bytes
+			if err := fc.archive.CallContext(context.Background(), &code, "eth_getCode", address, fc.forkBlock); err != nil {
+				return nil, err
+			}
+			fc.code[result.CodeHash] = code
+		}
+	}
+	fc.accounts[address] = account
+	return account, nil
+}
+
+// storageValue returns the value of the storage slot as of the fork block, fetching
+// it from the archive if it has not been fetched before
+func (fc *forkCache) storageValue(address common.Address, key common.Hash) ([]byte, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if value, ok := fc.storage[address][key]; ok {
+		return value, nil
+	}
+	var value hexutil.Bytes
+	if err := fc.archive.CallContext(context.Background(), &value, "eth_getStorageAt", address, key, fc.forkBlock); err != nil {
+		return nil, err
+	}
+	if fc.storage[address] == nil {
+		fc.storage[address] = make(map[common.Hash][]byte)
+	}
+	trimmed := common.CopyBytes(bytes.TrimLeft(value, "\x00"))
+	fc.storage[address][key] = trimmed
+	return trimmed, nil
+}
+
+var emptyCodeHash = crypto.Keccak256Hash(nil)
+
+// forkReader is a state reader that reads the accounts it does not find in the
+// local state from the archive node of a forked backend
+type forkReader struct {
+	local state.StateReader
+	fork  *forkCache
+}
+
+func (fr *forkReader) ReadAccountData(address common.Address) (*state.Account, error) {
+	account, err := fr.local.ReadAccountData(address)
+	if err != nil || account != nil {
+		return account, err
+	}
+	return fr.fork.account(address)
+}
+
+func (fr *forkReader) ReadAccountStorage(address common.Address, key *common.Hash) ([]byte, error) {
+	account, err := fr.local.ReadAccountData(address)
+	if err != nil {
+		return nil, err
+	}
+	if account != nil {
+		return fr.local.ReadAccountStorage(address, key)
+	}
+	// Storage of the accounts that only exist remotely
+	if account, err = fr.fork.account(address); err != nil || account == nil || account.Root == types.EmptyRootHash {
+		return nil, err
+	}
+	return fr.fork.storageValue(address, *key)
+}
+
+func (fr *forkReader) ReadAccountCode(codeHash common.Hash) ([]byte, error) {
+	fr.fork.mu.Lock()
+	code, ok := fr.fork.code[codeHash]
+	fr.fork.mu.Unlock()
+	if ok {
+		return code, nil
+	}
+	return fr.local.ReadAccountCode(codeHash)
+}
+
+func (fr *forkReader) ReadAccountCodeSize(codeHash common.Hash) (int, error) {
+	code, err := fr.ReadAccountCode(codeHash)
+	if err != nil {
+		return 0, err
+	}
+	return len(code), nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package backends_test
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth"
+	"github.com/ledgerwatch/turbo-geth/accounts/abi/bind/backends"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/internal/ethapi"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+// mockArchive serves the state of a single contract as of a single block
+type mockArchive struct {
+	blockNr  uint64
+	contract common.Address
+	balance  *big.Int
+	code     []byte
+	storage  map[common.Hash]common.Hash
+	requests int
+}
+
+func (m *mockArchive) checkBlock(blockNr hexutil.Uint64) error {
+	m.requests++
+	if uint64(blockNr) != m.blockNr {
+		return fmt.Errorf("unexpected block %d", blockNr)
+	}
+	return nil
+}
+
+func (m *mockArchive) GetProof(address common.Address, storageKeys []string, blockNr hexutil.Uint64) (*ethapi.AccountResult, error) {
+	if err := m.checkBlock(blockNr); err != nil {
+		return nil, err
+	}
+	if address != m.contract {
+		return &ethapi.AccountResult{Address: address, Balance: &hexutil.Big{}, CodeHash: crypto.Keccak256Hash(nil), StorageHash: types.EmptyRootHash}, nil
+	}
+	return &ethapi.AccountResult{
+		Address:     address,
+		Balance:     (*hexutil.Big)(m.balance),
+		CodeHash:    crypto.Keccak256Hash(m.code),
+		Nonce:       1,
+		StorageHash: common.HexToHash("0x01"), // Any non-empty root
+	}, nil
+}
+
+func (m *mockArchive) GetCode(address common.Address, blockNr hexutil.Uint64) (hexutil.Bytes, error) {
+	if err := m.checkBlock(blockNr); err != nil {
+		return nil, err
+	}
+	if address != m.contract {
+		return nil, nil
+	}
+	return m.code, nil
+}
+
+func (m *mockArchive) GetStorageAt(address common.Address, key common.Hash, blockNr hexutil.Uint64) (hexutil.Bytes, error) {
+	if err := m.checkBlock(blockNr); err != nil {
+		return nil, err
+	}
+	value := m.storage[key]
+	if address != m.contract {
+		value = common.Hash{}
+	}
+	return value[:], nil
+}
+
+func TestForkedSimulatedBackend(t *testing.T) {
+	// Contract returning the slot 0: PUSH1 0 SLOAD PUSH1 0 MSTORE PUSH1 32 PUSH1 0 RETURN
+	archive := &mockArchive{
+		blockNr:  1000,
+		contract: common.HexToAddress("0x0200000000000000000000000000000000000002"),
+		balance:  big.NewInt(5000),
+		code:     common.FromHex("60005460005260206000f3"),
+		storage:  map[common.Hash]common.Hash{{}: common.BigToHash(big.NewInt(42))},
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", archive); err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.DialInProc(server)
+	defer client.Close()
+	sim := backends.NewForkedSimulatedBackend(client, archive.blockNr, nil)
+
+	call := ethereum.CallMsg{From: testAddr, To: &archive.contract}
+	res, err := sim.CallContract(context.Background(), call, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if common.BytesToHash(res) != common.BigToHash(big.NewInt(42)) {
+		t.Errorf("expected the remote contract to return 42, got %x", res)
+	}
+	if balance, err := sim.BalanceAt(context.Background(), archive.contract, nil); err != nil || balance.Int64() != 5000 {
+		t.Errorf("expected the remote balance 5000, got %v, err %v", balance, err)
+	}
+	if code, err := sim.CodeAt(context.Background(), archive.contract, nil); err != nil || common.Bytes2Hex(code) != common.Bytes2Hex(archive.code) {
+		t.Errorf("expected the remote code, got %x, err %v", code, err)
+	}
+	// Repeated call is served from the cache
+	requests := archive.requests
+	if _, err = sim.CallContract(context.Background(), call, nil); err != nil {
+		t.Fatal(err)
+	}
+	if archive.requests != requests {
+		t.Errorf("expected no new requests to the archive, got %d", archive.requests-requests)
+	}
+}
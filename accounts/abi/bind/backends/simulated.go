@@ -21,12 +21,14 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ledgerwatch/turbo-geth"
 	"github.com/ledgerwatch/turbo-geth/accounts/abi/bind"
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
 	"github.com/ledgerwatch/turbo-geth/common/math"
 	"github.com/ledgerwatch/turbo-geth/consensus"
 	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
@@ -36,9 +38,11 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/state"
 	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/eth/filters"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/event"
+	"github.com/ledgerwatch/turbo-geth/internal/ethapi"
 	"github.com/ledgerwatch/turbo-geth/params"
 	"github.com/ledgerwatch/turbo-geth/rpc"
 )
@@ -48,24 +52,49 @@ var _ bind.ContractBackend = (*SimulatedBackend)(nil)
 
 var errBlockNumberUnsupported = errors.New("SimulatedBackend cannot access blocks other than the latest block")
 var errGasEstimationFailed = errors.New("gas required exceeds allowance or always failing transaction")
+var errExecutionTimeout = errors.New("execution timeout")
+
+// ErrResultTooLarge is returned by FilterLogs together with the truncated results
+// when the query matches more logs than allowed by SetMaxLogResults.
+var ErrResultTooLarge = errors.New("query returned more than the allowed number of results")
+
+// ErrStatePruned is returned when the state of a block outside of the retention
+// window set by SetStateRetention is requested.
+var ErrStatePruned = errors.New("state pruned: block is older than the state retention window")
+
+// Categories of the errors of the committed transactions, see TransactionError
+const (
+	TxErrorOutOfGas      = "out of gas"
+	TxErrorRevert        = "revert"
+	TxErrorInvalidOpcode = "invalid opcode"
+)
 
 // SimulatedBackend implements bind.ContractBackend, simulating a blockchain in
 // the background. Its main purpose is to allow easily testing contract bindings.
 type SimulatedBackend struct {
 	prependDb  ethdb.Database
 	database   ethdb.Database // In memory database to store our testing data
-	engine     consensus.Engine
+	engine     *balanceEngine
 	blockchain *core.BlockChain // Ethereum blockchain to handle the consensus
 
-	mu            sync.Mutex
-	prependBlock  *types.Block
-	pendingHeader *types.Header
-	gasPool       *core.GasPool
-	pendingBlock  *types.Block // Currently pending block that will be imported on request
-	pendingTds    *state.TrieDbState
-	pendingState  *state.StateDB // Currently pending state that will be the active on on request
+	mu              sync.Mutex
+	prependBlock    *types.Block
+	pendingHeader   *types.Header
+	gasPool         *core.GasPool
+	pendingBlock    *types.Block   // Currently pending block that will be imported on request
+	pendingReceipts types.Receipts // Receipts of the transactions in the pending block
+	pendingTds      *state.TrieDbState
+	pendingState    *state.StateDB         // Currently pending state that will be the active on on request
+	lastReceipts    types.Receipts         // Receipts of the last committed block (prependBlock)
+	pendingTxErrors map[common.Hash]string // Error categories of the transactions in the pending block
+	txErrors        map[common.Hash]string // Error categories of the committed transactions
+	callTimeout     time.Duration          // Wall-clock limit for a single contract call, zero means no limit
+	maxLogResults   int                    // Maximum number of logs returned by FilterLogs, zero means no limit
+	stateRetention  uint64                 // Number of blocks behind the head whose state is kept, zero keeps all
+	prunedTo        uint64                 // Oldest block whose state is still available
 
 	events *filters.EventSystem // Event system for filtering log events live
+	fork   *forkCache           // State fetched from the archive node of a forked backend, nil if not forked
 
 	config *params.ChainConfig
 }
@@ -73,10 +102,14 @@ type SimulatedBackend struct {
 // NewSimulatedBackend creates a new binding backend using a simulated blockchain
 // for testing purposes.
 func NewSimulatedBackend(alloc core.GenesisAlloc, gasLimit uint64) *SimulatedBackend {
+	return newSimulatedBackend(alloc, gasLimit, params.AllEthashProtocolChanges)
+}
+
+func newSimulatedBackend(alloc core.GenesisAlloc, gasLimit uint64, config *params.ChainConfig) *SimulatedBackend {
 	database := ethdb.NewMemDatabase()
-	genesis := core.Genesis{Config: params.AllEthashProtocolChanges, GasLimit: gasLimit, Alloc: alloc}
+	genesis := core.Genesis{Config: config, GasLimit: gasLimit, Alloc: alloc}
 	genesisBlock := genesis.MustCommit(database)
-	engine := ethash.NewFaker()
+	engine := &balanceEngine{Engine: ethash.NewFaker(), balances: make(map[uint64]map[common.Address]*big.Int)}
 	blockchain, err := core.NewBlockChain(database, nil, genesis.Config, engine, vm.Config{}, nil)
 	if err != nil {
 		panic(fmt.Sprintf("%v", err))
@@ -90,6 +123,7 @@ func NewSimulatedBackend(alloc core.GenesisAlloc, gasLimit uint64) *SimulatedBac
 		engine:       engine,
 		blockchain:   blockchain,
 		config:       genesis.Config,
+		txErrors:     make(map[common.Hash]string),
 		events:       filters.NewEventSystem(new(event.TypeMux), &filterBackend{database, blockchain}, false),
 	}
 	backend.emptyPendingBlock()
@@ -101,14 +135,86 @@ func NewSimulatedBackend(alloc core.GenesisAlloc, gasLimit uint64) *SimulatedBac
 func (b *SimulatedBackend) Commit() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+
+	b.commitLocked()
+}
+
+// commitLocked is Commit for callers already holding the lock.
+func (b *SimulatedBackend) commitLocked() {
 	if _, err := b.blockchain.InsertChain([]*types.Block{b.pendingBlock}); err != nil {
 		panic(err)
 	}
 	b.prependDb = b.database
 	b.prependBlock = b.pendingBlock
+	b.lastReceipts = b.pendingReceipts
+	for txHash, category := range b.pendingTxErrors {
+		b.txErrors[txHash] = category
+	}
+	if err := b.pruneStates(); err != nil {
+		panic(err)
+	}
 	b.emptyPendingBlock()
 }
 
+// LastCommitted returns the block imported by the last Commit, together with the
+// receipts of its transactions. Before the first Commit, it returns the genesis block.
+func (b *SimulatedBackend) LastCommitted() (*types.Block, types.Receipts) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.prependBlock, b.lastReceipts
+}
+
+// SetCallTimeout limits the wall-clock time of the contract calls (CallContract,
+// PendingCallContract, EstimateGas). A call running longer than that is aborted
+// and fails with the "execution timeout" error. Zero disables the limit.
+func (b *SimulatedBackend) SetCallTimeout(timeout time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.callTimeout = timeout
+}
+
+// SetMaxLogResults limits the number of logs returned by FilterLogs. A query
+// matching more logs returns only the first limit of them together with
+// ErrResultTooLarge. Zero disables the limit.
+func (b *SimulatedBackend) SetMaxLogResults(limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.maxLogResults = limit
+}
+
+// SetStateRetention limits the states of the committed blocks kept by the backend
+// to the states of the last blocks blocks behind the head. The history of the
+// older states is pruned on every Commit, while their headers, transactions and
+// receipts are kept. Reading the state of a pruned block fails with ErrStatePruned.
+// Zero keeps all the states.
+func (b *SimulatedBackend) SetStateRetention(blocks uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stateRetention = blocks
+}
+
+// pruneStates removes the change sets that are only needed to read the states of
+// the blocks outside of the retention window. The state after the block n is read
+// from the change sets of the blocks after n, so removing the change sets up to
+// the block n keeps the state of the block n available.
+func (b *SimulatedBackend) pruneStates() error {
+	head := b.blockchain.CurrentBlock().NumberU64()
+	if b.stateRetention == 0 || head <= b.stateRetention {
+		return nil
+	}
+	for blockNr := b.prunedTo + 1; blockNr <= head-b.stateRetention; blockNr++ {
+		if err := b.database.DeleteTimestamp(blockNr); err != nil {
+			return err
+		}
+		b.prunedTo = blockNr
+	}
+	return nil
+}
+
 // Rollback aborts all pending transactions, reverting to the last committed state.
 func (b *SimulatedBackend) Rollback() {
 	b.mu.Lock()
@@ -118,12 +224,14 @@ func (b *SimulatedBackend) Rollback() {
 }
 
 func (b *SimulatedBackend) emptyPendingBlock() {
-	blocks, _ := core.GenerateChain(b.config, b.prependBlock, ethash.NewFaker(), b.prependDb.MemCopy(), 1, func(int, *core.BlockGen) {})
+	blocks, receipts := core.GenerateChain(b.config, b.prependBlock, b.engine, b.prependDb.MemCopy(), 1, func(int, *core.BlockGen) {})
 	b.pendingBlock = blocks[0]
+	b.pendingReceipts = receipts[0]
 	b.pendingHeader = b.pendingBlock.Header()
 	b.gasPool = new(core.GasPool).AddGas(b.pendingHeader.GasLimit)
 	b.pendingTds, _ = state.NewTrieDbState(b.prependBlock.Root(), b.prependDb.MemCopy(), b.prependBlock.NumberU64())
 	b.pendingState = state.New(b.pendingTds)
+	b.pendingTxErrors = make(map[common.Hash]string)
 }
 
 func (b *SimulatedBackend) prependingState() (*state.StateDB, error) {
@@ -131,6 +239,9 @@ func (b *SimulatedBackend) prependingState() (*state.StateDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	if b.fork != nil {
+		return state.New(&forkReader{local: tds, fork: b.fork}), nil
+	}
 	return state.New(tds), nil
 }
 
@@ -201,6 +312,26 @@ func (b *SimulatedBackend) TransactionReceipt(ctx context.Context, txHash common
 	return receipt, nil
 }
 
+// TransactionByHash returns the transaction with the given hash together with its
+// position in the chain. For a transaction in the pending block, isPending is true,
+// blockHash and blockNumber are zero and index is the position in the pending block.
+// The returned error is ethereum.NotFound if the transaction is not known.
+func (b *SimulatedBackend) TransactionByHash(ctx context.Context, txHash common.Hash) (tx *types.Transaction, blockHash common.Hash, blockNumber uint64, index uint64, isPending bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, ptx := range b.pendingBlock.Transactions() {
+		if ptx.Hash() == txHash {
+			return ptx, common.Hash{}, 0, uint64(i), true, nil
+		}
+	}
+	tx, blockHash, blockNumber, index = rawdb.ReadTransaction(b.database, txHash)
+	if tx == nil {
+		return nil, common.Hash{}, 0, 0, false, ethereum.NotFound
+	}
+	return tx, blockHash, blockNumber, index, false, nil
+}
+
 // PendingCodeAt returns the code associated with an account in the pending state.
 func (b *SimulatedBackend) PendingCodeAt(ctx context.Context, contract common.Address) ([]byte, error) {
 	b.mu.Lock()
@@ -225,6 +356,71 @@ func (b *SimulatedBackend) CallContract(ctx context.Context, call ethereum.CallM
 	return rval, err
 }
 
+// StateOverride is a set of changes to an account applied before the call made by
+// CallContractWithOverrides. Nil fields leave the respective part of the account
+// unchanged.
+type StateOverride struct {
+	Code    []byte
+	Balance *big.Int
+	Nonce   *uint64
+	Storage map[common.Hash]common.Hash // Slots to set, the other slots keep their values
+}
+
+// CallContractWithOverrides executes a contract call like CallContract, on a copy
+// of the state in which the given accounts are modified by the overrides first.
+// The overrides do not persist after the call.
+func (b *SimulatedBackend) CallContractWithOverrides(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int, overrides map[common.Address]StateOverride) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if blockNumber != nil && blockNumber.Cmp(b.blockchain.CurrentBlock().Number()) != 0 {
+		return nil, errBlockNumberUnsupported
+	}
+	statedb, err := b.prependingState()
+	if err != nil {
+		return nil, err
+	}
+	for addr, override := range overrides {
+		if override.Code != nil {
+			statedb.SetCode(addr, override.Code)
+		}
+		if override.Balance != nil {
+			statedb.SetBalance(addr, override.Balance)
+		}
+		if override.Nonce != nil {
+			statedb.SetNonce(addr, *override.Nonce)
+		}
+		for key, value := range override.Storage {
+			statedb.SetState(addr, key, value)
+		}
+	}
+	rval, _, _, err := b.callContract(ctx, call, b.blockchain.CurrentBlock(), statedb)
+	return rval, err
+}
+
+// CallContractWithLogs executes a contract call like CallContract, and also returns
+// the logs emitted during the call. Since the call is not a part of any transaction,
+// the logs have empty transaction hash.
+func (b *SimulatedBackend) CallContractWithLogs(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, []*types.Log, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if blockNumber != nil && blockNumber.Cmp(b.blockchain.CurrentBlock().Number()) != 0 {
+		return nil, nil, errBlockNumberUnsupported
+	}
+	statedb, err := b.prependingState()
+	if err != nil {
+		return nil, nil, err
+	}
+	block := b.blockchain.CurrentBlock()
+	statedb.Prepare(common.Hash{}, block.Hash(), 0)
+	rval, _, _, err := b.callContract(ctx, call, block, statedb)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rval, statedb.GetLogs(common.Hash{}), nil
+}
+
 // PendingCallContract executes a contract call on the pending state.
 func (b *SimulatedBackend) PendingCallContract(ctx context.Context, call ethereum.CallMsg) ([]byte, error) {
 	b.mu.Lock()
@@ -250,6 +446,78 @@ func (b *SimulatedBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error
 	return big.NewInt(1), nil
 }
 
+// GetPendingProof returns the proof of the account and of the given storage keys
+// against the state root of the pending block, in the format of eth_getProof.
+func (b *SimulatedBackend) GetPendingProof(address common.Address, keys []common.Hash) (*ethapi.AccountResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Re-execute the pending block, so that the tries include the block rewards
+	tds, err := state.NewTrieDbState(b.prependBlock.Root(), b.prependDb.MemCopy(), b.prependBlock.NumberU64())
+	if err != nil {
+		return nil, err
+	}
+	statedb := state.New(tds)
+	processor := core.NewStateProcessor(b.config, b.blockchain, b.engine)
+	if _, _, _, err = processor.Process(b.pendingBlock, statedb, tds, vm.Config{}); err != nil {
+		return nil, err
+	}
+	blockNr := b.prependBlock.NumberU64()
+	var accountProof proofList
+	if err = tds.AccountTrie().Prove(tds.Database(), crypto.Keccak256(address[:]), 0, &accountProof, blockNr); err != nil {
+		return nil, err
+	}
+	storageHash := types.EmptyRootHash
+	codeHash := statedb.GetCodeHash(address)
+	storageProof := make([]ethapi.StorageResult, len(keys))
+	if statedb.Exist(address) {
+		storageTrie, err := tds.StorageTrie(address)
+		if err != nil {
+			return nil, err
+		}
+		storageHash = storageTrie.Hash()
+		for i, key := range keys {
+			var proof proofList
+			if err = storageTrie.Prove(tds.Database(), crypto.Keccak256(key[:]), 0, &proof, blockNr); err != nil {
+				return nil, err
+			}
+			value := statedb.GetState(address, key)
+			storageProof[i] = ethapi.StorageResult{Key: key.Hex(), Value: (*hexutil.Big)(value.Big()), Proof: common.ToHexArray(proof)}
+		}
+	} else {
+		// Account that does not exist has no code and no storage
+		codeHash = crypto.Keccak256Hash(nil)
+		for i, key := range keys {
+			storageProof[i] = ethapi.StorageResult{Key: key.Hex(), Value: &hexutil.Big{}, Proof: []string{}}
+		}
+	}
+	return &ethapi.AccountResult{
+		Address:      address,
+		AccountProof: common.ToHexArray(accountProof),
+		Balance:      (*hexutil.Big)(statedb.GetBalance(address)),
+		CodeHash:     codeHash,
+		Nonce:        hexutil.Uint64(statedb.GetNonce(address)),
+		StorageHash:  storageHash,
+		StorageProof: storageProof,
+	}, statedb.Error()
+}
+
+// proofList collects the nodes of a proof in the order Trie.Prove produces them.
+type proofList [][]byte
+
+func (n *proofList) Put(bucket, key, value []byte) error {
+	*n = append(*n, value)
+	return nil
+}
+
+func (n *proofList) PutS(hBucket, key, value []byte, timestamp uint64) error {
+	return nil
+}
+
+func (n *proofList) DeleteTimestamp(timestamp uint64) error {
+	return nil
+}
+
 // EstimateGas executes the requested code against the currently pending block/state and
 // returns the used amount of gas.
 func (b *SimulatedBackend) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
@@ -325,15 +593,98 @@ func (b *SimulatedBackend) callContract(ctx context.Context, call ethereum.CallM
 	vmenv := vm.NewEVM(evmContext, statedb, b.config, vm.Config{})
 	gaspool := new(core.GasPool).AddGas(math.MaxUint64)
 
-	return core.NewStateTransition(vmenv, msg, gaspool).TransitionDb()
+	// Abort the execution when the context is done, either because the caller
+	// cancelled it, or because the call timeout has been reached
+	var cancel context.CancelFunc
+	if b.callTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, b.callTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			vmenv.Cancel()
+		case <-done:
+		}
+	}()
+
+	rval, gas, failed, err := core.NewStateTransition(vmenv, msg, gaspool).TransitionDb()
+	close(done)
+	<-stopped
+	// The interpreter stops silently when cancelled, so only the calls that were
+	// actually cancelled are reported as such
+	if vmenv.Cancelled() {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, 0, false, errExecutionTimeout
+		}
+		return nil, 0, false, ctx.Err()
+	}
+	return rval, gas, failed, err
 }
 
-// SendTransaction updates the pending block to include the given transaction.
-// It panics if the transaction is invalid.
-func (b *SimulatedBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+// TraceBlock re-executes all the transactions of the committed block with the given
+// number (the latest block if blockNumber is nil) on the state at the start of the
+// block, with the same tracer for all of them, and returns their receipts. If the
+// state at the start of the block has been pruned, it returns ErrStatePruned.
+func (b *SimulatedBackend) TraceBlock(blockNumber *big.Int, tracer vm.Tracer) ([]*types.Receipt, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	block := b.blockchain.CurrentBlock()
+	if blockNumber != nil {
+		block = b.blockchain.GetBlockByNumber(blockNumber.Uint64())
+		if block == nil {
+			return nil, fmt.Errorf("block %d not found", blockNumber)
+		}
+	}
+	if block.NumberU64() == 0 {
+		// Genesis block has no transactions
+		return nil, nil
+	}
+	parent := b.blockchain.GetBlock(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return nil, fmt.Errorf("parent of block %d not found", block.NumberU64())
+	}
+	if parent.NumberU64() < b.prunedTo {
+		return nil, ErrStatePruned
+	}
+	tds, err := state.NewTrieDbState(parent.Root(), b.database.MemCopy(), parent.NumberU64())
+	if err != nil {
+		return nil, err
+	}
+	tds.SetHistorical(true)
+	statedb := state.New(tds)
+	header := block.Header()
+	gp := new(core.GasPool).AddGas(block.GasLimit())
+	var usedGas uint64
+	receipts := make([]*types.Receipt, len(block.Transactions()))
+	for i, tx := range block.Transactions() {
+		statedb.Prepare(tx.Hash(), block.Hash(), i)
+		receipt, _, err := core.ApplyTransaction(b.config, b.blockchain, nil, gp, statedb, tds.TrieStateWriter(), header, tx, &usedGas, vm.Config{Debug: true, Tracer: tracer})
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d (%x): %v", i, tx.Hash(), err)
+		}
+		receipts[i] = receipt
+	}
+	return receipts, nil
+}
+
+// ValidateTransaction checks whether the given transaction would be accepted by
+// SendTransaction, without adding it to the pending block.
+func (b *SimulatedBackend) ValidateTransaction(tx *types.Transaction) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	return b.validateTransaction(tx)
+}
+
+// validateTransaction checks the sender, nonce, gas and balance of the transaction
+// against the pending block and state.
+func (b *SimulatedBackend) validateTransaction(tx *types.Transaction) error {
 	sender, err := types.Sender(types.HomesteadSigner{}, tx)
 	if err != nil {
 		return fmt.Errorf("invalid transaction: %v", err)
@@ -342,59 +693,286 @@ func (b *SimulatedBackend) SendTransaction(ctx context.Context, tx *types.Transa
 	if tx.Nonce() != nonce {
 		return fmt.Errorf("invalid transaction nonce: got %d, want %d", tx.Nonce(), nonce)
 	}
+	intrGas, err := core.IntrinsicGas(tx.Data(), tx.To() == nil, b.config.IsHomestead(b.pendingHeader.Number))
+	if err != nil {
+		return err
+	}
+	if tx.Gas() < intrGas {
+		return core.ErrIntrinsicGas
+	}
+	if tx.Gas() > b.gasPool.Gas() {
+		return core.ErrGasLimitReached
+	}
+	if b.pendingState.GetBalance(sender).Cmp(tx.Cost()) < 0 {
+		return core.ErrInsufficientFunds
+	}
+	return nil
+}
+
+// SendTransaction updates the pending block to include the given transaction.
+// It panics if the transaction is invalid.
+func (b *SimulatedBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.validateTransaction(tx); err != nil {
+		return err
+	}
 
 	b.pendingState.Prepare(tx.Hash(), common.Hash{}, len(b.pendingBlock.Transactions()))
+	tracer := &txErrorTracer{}
 	if _, _, err := core.ApplyTransaction(
 		b.config, b.blockchain,
 		&b.pendingHeader.Coinbase, b.gasPool,
 		b.pendingState, b.pendingTds.TrieStateWriter(),
 		b.pendingHeader, tx,
-		&b.pendingHeader.GasUsed, vm.Config{}); err != nil {
+		&b.pendingHeader.GasUsed, vm.Config{Debug: true, Tracer: tracer}); err != nil {
 		return err
 	}
-	blocks, _ := core.GenerateChain(b.config, b.prependBlock, ethash.NewFaker(), b.prependDb.MemCopy(), 1, func(number int, block *core.BlockGen) {
+	b.pendingTxErrors[tx.Hash()] = txErrorCategory(tracer.err)
+	blocks, receipts := core.GenerateChain(b.config, b.prependBlock, b.engine, b.prependDb.MemCopy(), 1, func(number int, block *core.BlockGen) {
 		for _, tx := range b.pendingBlock.Transactions() {
 			block.AddTxWithChain(b.blockchain, tx)
 		}
 		block.AddTxWithChain(b.blockchain, tx)
+		for _, uncle := range b.pendingBlock.Uncles() {
+			block.AddUncle(uncle)
+		}
+	})
+	b.pendingBlock = blocks[0]
+	b.pendingReceipts = receipts[0]
+	b.pendingHeader = b.pendingBlock.Header()
+	return nil
+}
+
+// TransactionError returns the category of the error that made the committed
+// transaction fail: TxErrorOutOfGas, TxErrorRevert, TxErrorInvalidOpcode, or the
+// message of any other EVM error. It is empty for a successful transaction. Both
+// out-of-gas and reverted transactions have the failed status in their receipts,
+// this tells them apart. The returned error is ethereum.NotFound if the transaction
+// has not been committed by this backend.
+func (b *SimulatedBackend) TransactionError(txHash common.Hash) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	category, ok := b.txErrors[txHash]
+	if !ok {
+		return "", ethereum.NotFound
+	}
+	return category, nil
+}
+
+// txErrorTracer remembers the error the top level call of a transaction ended with.
+type txErrorTracer struct {
+	err error
+}
+
+func (t *txErrorTracer) CaptureStart(depth int, from common.Address, to common.Address, call bool, input []byte, gas uint64, value *big.Int) error {
+	return nil
+}
+
+func (t *txErrorTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+func (t *txErrorTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+func (t *txErrorTracer) CaptureEnd(depth int, output []byte, gasUsed uint64, d time.Duration, err error) error {
+	if depth == 0 {
+		t.err = err
+	}
+	return nil
+}
+
+func (t *txErrorTracer) CaptureCreate(creator common.Address, creation common.Address) error {
+	return nil
+}
+
+func (t *txErrorTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *txErrorTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+func txErrorCategory(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case err == vm.ErrOutOfGas || err == vm.ErrCodeStoreOutOfGas:
+		return TxErrorOutOfGas
+	case err == vm.ErrExecutionReverted:
+		return TxErrorRevert
+	case strings.HasPrefix(err.Error(), "invalid opcode"):
+		// The interpreter does not have a dedicated error value for it
+		return TxErrorInvalidOpcode
+	default:
+		return err.Error()
+	}
+}
+
+// AddUncle stages the header to be included as an uncle into the pending block,
+// and hence into the next committed block. The header is verified by the consensus
+// engine as an uncle of the pending block, so it needs to be a sibling of one of the
+// recent ancestors, with the correct difficulty, and not included before.
+func (b *SimulatedBackend) AddUncle(uncle *types.Header) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	blocks, receipts := core.GenerateChain(b.config, b.prependBlock, b.engine, b.prependDb.MemCopy(), 1, func(number int, block *core.BlockGen) {
+		for _, tx := range b.pendingBlock.Transactions() {
+			block.AddTxWithChain(b.blockchain, tx)
+		}
+		for _, u := range b.pendingBlock.Uncles() {
+			block.AddUncle(u)
+		}
+		block.AddUncle(uncle)
 	})
+	if err := b.engine.VerifyUncles(b.blockchain, blocks[0]); err != nil {
+		return fmt.Errorf("invalid uncle: %v", err)
+	}
 	b.pendingBlock = blocks[0]
+	b.pendingReceipts = receipts[0]
 	b.pendingHeader = b.pendingBlock.Header()
 	return nil
 }
 
+// SetBalance sets the balance of the account addr to balance without a transaction.
+// It commits the pending transactions as a new block, at the end of which the
+// balance is set, so the chain advances by one block as with Commit.
+func (b *SimulatedBackend) SetBalance(addr common.Address, balance *big.Int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	number := b.pendingBlock.NumberU64()
+	if b.engine.balances[number] == nil {
+		b.engine.balances[number] = make(map[common.Address]*big.Int)
+	}
+	b.engine.balances[number][addr] = new(big.Int).Set(balance)
+	blocks, receipts := core.GenerateChain(b.config, b.prependBlock, b.engine, b.prependDb.MemCopy(), 1, func(number int, block *core.BlockGen) {
+		for _, tx := range b.pendingBlock.Transactions() {
+			block.AddTxWithChain(b.blockchain, tx)
+		}
+		for _, uncle := range b.pendingBlock.Uncles() {
+			block.AddUncle(uncle)
+		}
+	})
+	b.pendingBlock = blocks[0]
+	b.pendingReceipts = receipts[0]
+	b.pendingHeader = b.pendingBlock.Header()
+	b.commitLocked()
+	delete(b.engine.balances, number)
+}
+
+// balanceEngine is the consensus engine of the simulated blockchain. In addition
+// to the block rewards, it sets the balances requested by SetBalance at the end
+// of the blocks they were requested for. It is only accessed under the lock of
+// the backend.
+type balanceEngine struct {
+	consensus.Engine
+	balances map[uint64]map[common.Address]*big.Int // Balances to set, by block number
+}
+
+// Finalize implements consensus.Engine, setting the requested balances after
+// accumulating the rewards.
+func (e *balanceEngine) Finalize(chainConfig *params.ChainConfig, header *types.Header, state *state.StateDB, txs []*types.Transaction, uncles []*types.Header, receipts []*types.Receipt) (*types.Block, error) {
+	block, err := e.Engine.Finalize(chainConfig, header, state, txs, uncles, receipts)
+	for addr, balance := range e.balances[header.Number.Uint64()] {
+		state.SetBalance(addr, balance)
+	}
+	return block, err
+}
+
 // FilterLogs executes a log filter operation, blocking during execution and
-// returning all the results in one batch.
+// returning all the results in one batch. If the results exceed the limit set
+// by SetMaxLogResults, they are truncated and ErrResultTooLarge is returned.
+// The filtering stops as soon as the limit is exceeded.
 //
 // TODO(karalabe): Deprecate when the subscription one can return past data too.
 func (b *SimulatedBackend) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
-	var filter *filters.Filter
+	b.mu.Lock()
+	limit := b.maxLogResults
+	b.mu.Unlock()
+
+	res := []types.Log{}
+	tooLarge := false
+	if err := b.filterLogs(ctx, query, func(log *types.Log) bool {
+		if limit > 0 && len(res) == limit {
+			// One more log than the limit is enough to know the results are truncated
+			tooLarge = true
+			return false
+		}
+		res = append(res, *log)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if tooLarge {
+		return res, ErrResultTooLarge
+	}
+	return res, nil
+}
+
+// FilterLogsStream executes a log filter operation like FilterLogs, but instead of
+// collecting the results, invokes cb for every matching log, in the order of the
+// blocks, stopping as soon as cb returns false. The limit set by SetMaxLogResults
+// does not apply to the streamed logs.
+func (b *SimulatedBackend) FilterLogsStream(ctx context.Context, query ethereum.FilterQuery, cb func(log types.Log) bool) error {
+	return b.filterLogs(ctx, query, func(log *types.Log) bool {
+		return cb(*log)
+	})
+}
+
+// filterLogs invokes cb for every log matching the query, in the order of the
+// blocks, stopping as soon as cb returns false. The blocks are filtered one at a
+// time, so only the logs of a single block are held in memory.
+func (b *SimulatedBackend) filterLogs(ctx context.Context, query ethereum.FilterQuery, cb func(log *types.Log) bool) error {
+	var hashes []common.Hash
 	if query.BlockHash != nil {
-		// Block filter requested, construct a single-shot filter
-		filter = filters.NewBlockFilter(&filterBackend{b.database, b.blockchain}, *query.BlockHash, query.Addresses, query.Topics)
+		hashes = append(hashes, *query.BlockHash)
 	} else {
-		// Initialize unset filter boundaried to run from genesis to chain head
-		from := int64(0)
+		b.mu.Lock()
+		head := b.blockchain.CurrentBlock().NumberU64()
+		b.mu.Unlock()
+		// Unset boundaries run from genesis to chain head, negative ones stand for the head
+		from, to := uint64(0), head
 		if query.FromBlock != nil {
-			from = query.FromBlock.Int64()
+			if query.FromBlock.Sign() < 0 {
+				from = head
+			} else {
+				from = query.FromBlock.Uint64()
+			}
 		}
-		to := int64(-1)
-		if query.ToBlock != nil {
-			to = query.ToBlock.Int64()
+		if query.ToBlock != nil && query.ToBlock.Sign() >= 0 && query.ToBlock.Uint64() < head {
+			to = query.ToBlock.Uint64()
+		}
+		for number := from; number <= to; number++ {
+			header := b.blockchain.GetHeaderByNumber(number)
+			if header == nil {
+				return fmt.Errorf("block %d not found", number)
+			}
+			hashes = append(hashes, header.Hash())
 		}
-		// Construct the range filter
-		filter = filters.NewRangeFilter(&filterBackend{b.database, b.blockchain}, from, to, query.Addresses, query.Topics)
-	}
-	// Run the filter and return all the logs
-	logs, err := filter.Logs(ctx)
-	if err != nil {
-		return nil, err
 	}
-	res := make([]types.Log, len(logs))
-	for i, log := range logs {
-		res[i] = *log
+	for _, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		filter := filters.NewBlockFilter(&filterBackend{b.database, b.blockchain}, hash, query.Addresses, query.Topics)
+		logs, err := filter.Logs(ctx)
+		if err != nil {
+			return err
+		}
+		for _, log := range logs {
+			if !cb(log) {
+				return nil
+			}
+		}
 	}
-	return res, nil
+	return nil
 }
 
 // SubscribeFilterLogs creates a background log filtering operation, returning a
@@ -435,13 +1013,17 @@ func (b *SimulatedBackend) SubscribeFilterLogs(ctx context.Context, query ethere
 func (b *SimulatedBackend) AdjustTime(adjustment time.Duration) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	blocks, _ := core.GenerateChain(b.config, b.prependBlock, ethash.NewFaker(), b.prependDb.MemCopy(), 1, func(number int, block *core.BlockGen) {
+	blocks, receipts := core.GenerateChain(b.config, b.prependBlock, b.engine, b.prependDb.MemCopy(), 1, func(number int, block *core.BlockGen) {
 		for _, tx := range b.pendingBlock.Transactions() {
 			block.AddTxWithChain(b.blockchain, tx)
 		}
+		for _, uncle := range b.pendingBlock.Uncles() {
+			block.AddUncle(uncle)
+		}
 		block.OffsetTime(int64(adjustment.Seconds()))
 	})
 	b.pendingBlock = blocks[0]
+	b.pendingReceipts = receipts[0]
 	b.pendingHeader = b.pendingBlock.Header()
 	return nil
 }
@@ -0,0 +1,708 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package backends_test
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth"
+	"github.com/ledgerwatch/turbo-geth/accounts/abi/bind/backends"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+var testKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+var testAddr = crypto.PubkeyToAddress(testKey.PublicKey)
+
+func newTestBackend() *backends.SimulatedBackend {
+	return backends.NewSimulatedBackend(core.GenesisAlloc{testAddr: {Balance: big.NewInt(10000000000)}}, 10000000)
+}
+
+func signTx(t *testing.T, tx *types.Transaction) *types.Transaction {
+	signed, err := types.SignTx(tx, types.HomesteadSigner{}, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestValidateTransaction(t *testing.T) {
+	sim := newTestBackend()
+	to := common.HexToAddress("0x0100000000000000000000000000000000000001")
+
+	valid := signTx(t, types.NewTransaction(0, to, big.NewInt(1000), params.TxGas, big.NewInt(1), nil))
+	if err := sim.ValidateTransaction(valid); err != nil {
+		t.Errorf("valid transaction rejected: %v", err)
+	}
+	// Validation must not change the pending state
+	if nonce, _ := sim.PendingNonceAt(context.Background(), testAddr); nonce != 0 {
+		t.Errorf("pending nonce changed by validation: %d", nonce)
+	}
+	wrongNonce := signTx(t, types.NewTransaction(1, to, big.NewInt(1000), params.TxGas, big.NewInt(1), nil))
+	if err := sim.ValidateTransaction(wrongNonce); err == nil {
+		t.Errorf("transaction with wrong nonce accepted")
+	}
+	tooExpensive := signTx(t, types.NewTransaction(0, to, big.NewInt(10000000000), params.TxGas, big.NewInt(1), nil))
+	if err := sim.ValidateTransaction(tooExpensive); err != core.ErrInsufficientFunds {
+		t.Errorf("expected %v, got %v", core.ErrInsufficientFunds, err)
+	}
+	lowGas := signTx(t, types.NewTransaction(0, to, big.NewInt(1000), params.TxGas-1, big.NewInt(1), nil))
+	if err := sim.ValidateTransaction(lowGas); err != core.ErrIntrinsicGas {
+		t.Errorf("expected %v, got %v", core.ErrIntrinsicGas, err)
+	}
+	// Once the valid transaction is sent, the next nonce becomes valid
+	if err := sim.SendTransaction(context.Background(), valid); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.ValidateTransaction(valid); err == nil {
+		t.Errorf("transaction with used nonce accepted")
+	}
+	if err := sim.ValidateTransaction(wrongNonce); err != nil {
+		t.Errorf("transaction with the next nonce rejected: %v", err)
+	}
+}
+
+func TestCallContractWithLogs(t *testing.T) {
+	// Contract storing 42 into memory and emitting it as a log with topic 1:
+	// PUSH1 42 PUSH1 0 MSTORE PUSH1 1 PUSH1 32 PUSH1 0 LOG1 STOP
+	contract := common.HexToAddress("0x0200000000000000000000000000000000000002")
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		testAddr: {Balance: big.NewInt(10000000000)},
+		contract: {Balance: new(big.Int), Code: common.FromHex("602a600052600160206000a100")},
+	}, 10000000)
+
+	_, logs, err := sim.CallContractWithLogs(context.Background(), ethereum.CallMsg{From: testAddr, To: &contract}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("expected 1 log, got %d", len(logs))
+	}
+	log := logs[0]
+	if log.Address != contract {
+		t.Errorf("wrong log address: %x", log.Address)
+	}
+	if len(log.Topics) != 1 || log.Topics[0] != common.BytesToHash([]byte{1}) {
+		t.Errorf("wrong log topics: %x", log.Topics)
+	}
+	if common.BytesToHash(log.Data) != common.BytesToHash([]byte{42}) {
+		t.Errorf("wrong log data: %x", log.Data)
+	}
+}
+
+func TestCallContractWithOverrides(t *testing.T) {
+	// Contract returning 1: PUSH1 1 PUSH1 0 MSTORE PUSH1 32 PUSH1 0 RETURN
+	contract := common.HexToAddress("0x0200000000000000000000000000000000000002")
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		testAddr: {Balance: big.NewInt(10000000000)},
+		contract: {Balance: new(big.Int), Code: common.FromHex("600160005260206000f3")},
+	}, 10000000)
+	call := ethereum.CallMsg{From: testAddr, To: &contract}
+
+	// Code returning the slot 7: PUSH1 7 SLOAD PUSH1 0 MSTORE PUSH1 32 PUSH1 0 RETURN
+	overrides := map[common.Address]backends.StateOverride{
+		contract: {
+			Code:    common.FromHex("60075460005260206000f3"),
+			Storage: map[common.Hash]common.Hash{common.BigToHash(big.NewInt(7)): common.BigToHash(big.NewInt(42))},
+		},
+	}
+	res, err := sim.CallContractWithOverrides(context.Background(), call, nil, overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if common.BytesToHash(res) != common.BigToHash(big.NewInt(42)) {
+		t.Errorf("expected the overridden code to return 42, got %x", res)
+	}
+	// Code returning its own balance: ADDRESS BALANCE PUSH1 0 MSTORE PUSH1 32 PUSH1 0 RETURN
+	overrides = map[common.Address]backends.StateOverride{
+		contract: {Code: common.FromHex("303160005260206000f3"), Balance: big.NewInt(12345)},
+	}
+	if res, err = sim.CallContractWithOverrides(context.Background(), call, nil, overrides); err != nil {
+		t.Fatal(err)
+	}
+	if common.BytesToHash(res) != common.BigToHash(big.NewInt(12345)) {
+		t.Errorf("expected the overridden balance 12345, got %x", res)
+	}
+	// Overrides do not persist
+	if res, err = sim.CallContract(context.Background(), call, nil); err != nil {
+		t.Fatal(err)
+	}
+	if common.BytesToHash(res) != common.BigToHash(big.NewInt(1)) {
+		t.Errorf("expected the original code to return 1, got %x", res)
+	}
+}
+
+func TestCallContractTimeout(t *testing.T) {
+	// Contract looping until it runs out of gas: JUMPDEST PUSH1 0 JUMP
+	contract := common.HexToAddress("0x0200000000000000000000000000000000000002")
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		testAddr: {Balance: big.NewInt(10000000000)},
+		contract: {Balance: new(big.Int), Code: common.FromHex("5b600056")},
+	}, 10000000)
+	sim.SetCallTimeout(50 * time.Millisecond)
+
+	// Small gas allowance runs out before the timeout
+	if _, err := sim.CallContract(context.Background(), ethereum.CallMsg{From: testAddr, To: &contract, Gas: 100000}, nil); err != nil {
+		t.Fatalf("unexpected error for bounded call: %v", err)
+	}
+	start := time.Now()
+	_, err := sim.CallContract(context.Background(), ethereum.CallMsg{From: testAddr, To: &contract, Gas: 1000000000000000}, nil)
+	if err == nil || err.Error() != "execution timeout" {
+		t.Fatalf("expected execution timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("call was not aborted in time, took %v", elapsed)
+	}
+	// Watchers of the finished calls do not outlive them
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		if _, err := sim.CallContract(context.Background(), ethereum.CallMsg{From: testAddr, To: &contract, Gas: 100000}, nil); err != nil {
+			t.Fatalf("unexpected error for bounded call: %v", err)
+		}
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("calls left %d goroutines running", n-goroutines)
+	}
+}
+
+func TestFilterLogsLimit(t *testing.T) {
+	// Contract emitting 1000 empty logs:
+	// PUSH2 1000 JUMPDEST PUSH1 0 PUSH1 0 LOG0 PUSH1 1 SWAP1 SUB DUP1 PUSH1 3 JUMPI STOP
+	contract := common.HexToAddress("0x0200000000000000000000000000000000000002")
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		testAddr: {Balance: big.NewInt(10000000000)},
+		contract: {Balance: new(big.Int), Code: common.FromHex("6103e85b60006000a0600190038060035700")},
+	}, 10000000)
+	for i := uint64(0); i < 3; i++ {
+		tx := signTx(t, types.NewTransaction(i, contract, new(big.Int), 1000000, big.NewInt(1), nil))
+		if err := sim.SendTransaction(context.Background(), tx); err != nil {
+			t.Fatal(err)
+		}
+		sim.Commit()
+	}
+	query := ethereum.FilterQuery{Addresses: []common.Address{contract}}
+	logs, err := sim.FilterLogs(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 3000 {
+		t.Fatalf("expected 3000 logs without a limit, got %d", len(logs))
+	}
+	sim.SetMaxLogResults(100)
+	truncated, err := sim.FilterLogs(context.Background(), query)
+	if err != backends.ErrResultTooLarge {
+		t.Fatalf("expected %v, got %v", backends.ErrResultTooLarge, err)
+	}
+	if len(truncated) != 100 {
+		t.Fatalf("expected 100 logs, got %d", len(truncated))
+	}
+	for i := range truncated {
+		if truncated[i].TxHash != logs[i].TxHash || truncated[i].Index != logs[i].Index {
+			t.Errorf("log %d differs from the unlimited results", i)
+		}
+	}
+	// Query within the limit is not truncated
+	query.FromBlock, query.ToBlock = big.NewInt(2), big.NewInt(2)
+	sim.SetMaxLogResults(1000)
+	if logs, err := sim.FilterLogs(context.Background(), query); err != nil || len(logs) != 1000 {
+		t.Errorf("expected 1000 logs, got %d, err %v", len(logs), err)
+	}
+}
+
+func TestFilterLogsStream(t *testing.T) {
+	// Contract emitting 1000 empty logs, same as in TestFilterLogsLimit
+	contract := common.HexToAddress("0x0200000000000000000000000000000000000002")
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		testAddr: {Balance: big.NewInt(10000000000)},
+		contract: {Balance: new(big.Int), Code: common.FromHex("6103e85b60006000a0600190038060035700")},
+	}, 10000000)
+	for i := uint64(0); i < 3; i++ {
+		tx := signTx(t, types.NewTransaction(i, contract, new(big.Int), 1000000, big.NewInt(1), nil))
+		if err := sim.SendTransaction(context.Background(), tx); err != nil {
+			t.Fatal(err)
+		}
+		sim.Commit()
+	}
+	for _, query := range []ethereum.FilterQuery{
+		{Addresses: []common.Address{contract}},
+		{FromBlock: big.NewInt(2), ToBlock: big.NewInt(3)},
+		{FromBlock: big.NewInt(3), ToBlock: big.NewInt(-1)},
+		{Addresses: []common.Address{testAddr}},
+	} {
+		logs, err := sim.FilterLogs(context.Background(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var streamed []types.Log
+		if err = sim.FilterLogsStream(context.Background(), query, func(log types.Log) bool {
+			streamed = append(streamed, log)
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(streamed) != len(logs) {
+			t.Fatalf("query %v: streamed %d logs, FilterLogs returned %d", query, len(streamed), len(logs))
+		}
+		for i := range logs {
+			if streamed[i].TxHash != logs[i].TxHash || streamed[i].Index != logs[i].Index || streamed[i].BlockNumber != logs[i].BlockNumber {
+				t.Errorf("query %v: log %d differs from FilterLogs", query, i)
+			}
+		}
+	}
+	// Streaming stops as soon as the callback returns false
+	calls := 0
+	if err := sim.FilterLogsStream(context.Background(), ethereum.FilterQuery{}, func(log types.Log) bool {
+		calls++
+		return calls < 1500
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1500 {
+		t.Errorf("expected 1500 callbacks before the termination, got %d", calls)
+	}
+}
+
+func TestSetBalance(t *testing.T) {
+	sim := newTestBackend()
+	to := common.HexToAddress("0x0100000000000000000000000000000000000001")
+	funded := common.HexToAddress("0x0300000000000000000000000000000000000003")
+
+	// Pending transaction is committed together with the new balance
+	tx := signTx(t, types.NewTransaction(0, to, big.NewInt(1000), params.TxGas, big.NewInt(1), nil))
+	if err := sim.SendTransaction(context.Background(), tx); err != nil {
+		t.Fatal(err)
+	}
+	sim.SetBalance(funded, big.NewInt(123456))
+	if block, _ := sim.LastCommitted(); block.NumberU64() != 1 {
+		t.Errorf("expected the chain to advance to block 1, got %d", block.NumberU64())
+	}
+	if balance, err := sim.BalanceAt(context.Background(), funded, nil); err != nil || balance.Int64() != 123456 {
+		t.Errorf("expected balance 123456, got %v, err %v", balance, err)
+	}
+	if balance, err := sim.BalanceAt(context.Background(), to, nil); err != nil || balance.Int64() != 1000 {
+		t.Errorf("expected balance 1000 from the pending transaction, got %v, err %v", balance, err)
+	}
+	// Existing account can be topped up and the new balance is spendable
+	sim.SetBalance(testAddr, big.NewInt(1000000000000))
+	if balance, err := sim.BalanceAt(context.Background(), testAddr, nil); err != nil || balance.Int64() != 1000000000000 {
+		t.Errorf("expected balance 1000000000000, got %v, err %v", balance, err)
+	}
+	tx = signTx(t, types.NewTransaction(1, to, big.NewInt(100000000000), params.TxGas, big.NewInt(1), nil))
+	if err := sim.SendTransaction(context.Background(), tx); err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	if balance, err := sim.BalanceAt(context.Background(), to, nil); err != nil || balance.Int64() != 100000001000 {
+		t.Errorf("expected balance 100000001000, got %v, err %v", balance, err)
+	}
+}
+
+func TestSetBalanceConcurrent(t *testing.T) {
+	sim := newTestBackend()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			sim.SetBalance(common.BigToAddress(big.NewInt(int64(i+1))), big.NewInt(int64(i+1)))
+		}(i)
+		go func() {
+			defer wg.Done()
+			sim.Commit()
+		}()
+	}
+	wg.Wait()
+	if block, _ := sim.LastCommitted(); block.NumberU64() != 20 {
+		t.Errorf("expected the chain to advance to block 20, got %d", block.NumberU64())
+	}
+	for i := 0; i < 10; i++ {
+		if balance, err := sim.BalanceAt(context.Background(), common.BigToAddress(big.NewInt(int64(i+1))), nil); err != nil || balance.Int64() != int64(i+1) {
+			t.Errorf("account %d: expected balance %d, got %v, err %v", i+1, i+1, balance, err)
+		}
+	}
+}
+
+func TestGetPendingProof(t *testing.T) {
+	// Contract storing 42 into the slot 1: PUSH1 42 PUSH1 1 SSTORE STOP
+	contract := common.HexToAddress("0x0200000000000000000000000000000000000002")
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		testAddr: {Balance: big.NewInt(10000000000)},
+		contract: {Balance: new(big.Int), Code: common.FromHex("602a60015500")},
+	}, 10000000)
+	tx := signTx(t, types.NewTransaction(0, contract, new(big.Int), 100000, big.NewInt(1), nil))
+	if err := sim.SendTransaction(context.Background(), tx); err != nil {
+		t.Fatal(err)
+	}
+	written, unset := common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(2))
+	result, err := sim.GetPendingProof(contract, []common.Hash{written, unset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pending block becomes the last committed block, with the same state root
+	sim.Commit()
+	block, _ := sim.LastCommitted()
+
+	accountValue, _, err := trie.VerifyProof(block.Root(), crypto.Keccak256(contract[:]), proofDb(t, result.AccountProof))
+	if err != nil {
+		t.Fatalf("failed to verify the account proof: %v", err)
+	}
+	if accountValue == nil {
+		t.Fatal("account proof proves absence of the account")
+	}
+	if result.CodeHash != crypto.Keccak256Hash(common.FromHex("602a60015500")) {
+		t.Errorf("wrong code hash %x", result.CodeHash)
+	}
+	if len(result.StorageProof) != 2 {
+		t.Fatalf("expected 2 storage proofs, got %d", len(result.StorageProof))
+	}
+	value, _, err := trie.VerifyProof(result.StorageHash, crypto.Keccak256(written[:]), proofDb(t, result.StorageProof[0].Proof))
+	if err != nil {
+		t.Fatalf("failed to verify the storage proof: %v", err)
+	}
+	if !bytes.Equal(value, []byte{42}) || result.StorageProof[0].Value.ToInt().Int64() != 42 {
+		t.Errorf("expected value 42, proof has %x, result has %v", value, result.StorageProof[0].Value)
+	}
+	value, _, err = trie.VerifyProof(result.StorageHash, crypto.Keccak256(unset[:]), proofDb(t, result.StorageProof[1].Proof))
+	if err != nil || value != nil {
+		t.Errorf("expected proof of absence for the unset slot, got %x, err %v", value, err)
+	}
+}
+
+// proofDb puts the hex-encoded proof nodes into a database keyed by their hashes
+func proofDb(t *testing.T, proof []string) ethdb.Database {
+	db := ethdb.NewMemDatabase()
+	for _, node := range proof {
+		enc := common.FromHex(node)
+		if err := db.Put([]byte("b"), crypto.Keccak256(enc), enc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// callTracer records the top-level calls of the traced transactions
+type callTracer struct {
+	to []common.Address
+}
+
+func (t *callTracer) CaptureStart(depth int, from common.Address, to common.Address, call bool, input []byte, gas uint64, value *big.Int) error {
+	if depth == 0 {
+		t.to = append(t.to, to)
+	}
+	return nil
+}
+
+func (t *callTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+func (t *callTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+func (t *callTracer) CaptureEnd(depth int, output []byte, gasUsed uint64, d time.Duration, err error) error {
+	return nil
+}
+
+func (t *callTracer) CaptureCreate(creator common.Address, creation common.Address) error {
+	return nil
+}
+
+func (t *callTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *callTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+func TestTraceBlock(t *testing.T) {
+	sim := newTestBackend()
+	first := common.HexToAddress("0x0100000000000000000000000000000000000001")
+	second := common.HexToAddress("0x0100000000000000000000000000000000000002")
+	var txs []*types.Transaction
+	for i, to := range []common.Address{first, second} {
+		tx := signTx(t, types.NewTransaction(uint64(i), to, big.NewInt(1000), params.TxGas, big.NewInt(1), nil))
+		if err := sim.SendTransaction(context.Background(), tx); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	sim.Commit()
+	// Later block changing the same accounts must not affect the trace
+	tx := signTx(t, types.NewTransaction(2, first, big.NewInt(1000), params.TxGas, big.NewInt(1), nil))
+	if err := sim.SendTransaction(context.Background(), tx); err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+
+	tracer := &callTracer{}
+	receipts, err := sim.TraceBlock(big.NewInt(1), tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.to) != 2 || tracer.to[0] != first || tracer.to[1] != second {
+		t.Errorf("expected the tracer to see calls to %x and %x, got %x", first, second, tracer.to)
+	}
+	if len(receipts) != 2 {
+		t.Fatalf("expected 2 receipts, got %d", len(receipts))
+	}
+	for i, receipt := range receipts {
+		committed, err := sim.TransactionReceipt(context.Background(), txs[i].Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful || receipt.CumulativeGasUsed != committed.CumulativeGasUsed {
+			t.Errorf("receipt %d: status %d, cumulative gas %d, committed receipt has %d", i, receipt.Status, receipt.CumulativeGasUsed, committed.CumulativeGasUsed)
+		}
+	}
+	if _, err := sim.TraceBlock(big.NewInt(10), tracer); err == nil {
+		t.Errorf("expected an error for a missing block")
+	}
+}
+
+func TestStateRetention(t *testing.T) {
+	sim := newTestBackend()
+	sim.SetStateRetention(2)
+	to := common.HexToAddress("0x0100000000000000000000000000000000000001")
+	var txs []*types.Transaction
+	sendBlock := func() {
+		tx := signTx(t, types.NewTransaction(uint64(len(txs)), to, big.NewInt(1000), params.TxGas, big.NewInt(1), nil))
+		if err := sim.SendTransaction(context.Background(), tx); err != nil {
+			t.Fatal(err)
+		}
+		sim.Commit()
+		txs = append(txs, tx)
+	}
+	for i := 0; i < 5; i++ {
+		sendBlock()
+	}
+	// Head is 5, the states of the blocks 3, 4 and 5 are kept
+	for blockNr := int64(4); blockNr <= 5; blockNr++ {
+		receipts, err := sim.TraceBlock(big.NewInt(blockNr), &callTracer{})
+		if err != nil {
+			t.Fatalf("block %d: %v", blockNr, err)
+		}
+		if len(receipts) != 1 || receipts[0].Status != types.ReceiptStatusSuccessful {
+			t.Errorf("block %d: expected one successful receipt, got %v", blockNr, receipts)
+		}
+	}
+	if _, err := sim.TraceBlock(big.NewInt(3), &callTracer{}); err != backends.ErrStatePruned {
+		t.Errorf("block 3: expected %v, got %v", backends.ErrStatePruned, err)
+	}
+	// Window advances with the head
+	sendBlock()
+	if _, err := sim.TraceBlock(big.NewInt(4), &callTracer{}); err != backends.ErrStatePruned {
+		t.Errorf("block 4: expected %v, got %v", backends.ErrStatePruned, err)
+	}
+	if _, err := sim.TraceBlock(big.NewInt(5), &callTracer{}); err != nil {
+		t.Errorf("block 5: %v", err)
+	}
+	// Receipts of the pruned blocks are kept
+	if receipt, err := sim.TransactionReceipt(context.Background(), txs[0].Hash()); err != nil || receipt == nil {
+		t.Errorf("expected the receipt of the first transaction, got %v, err %v", receipt, err)
+	}
+	if balance, err := sim.BalanceAt(context.Background(), to, nil); err != nil || balance.Int64() != 6000 {
+		t.Errorf("expected balance 6000 at the head, got %v, err %v", balance, err)
+	}
+}
+
+func TestLastCommitted(t *testing.T) {
+	sim := newTestBackend()
+	if block, receipts := sim.LastCommitted(); block.NumberU64() != 0 || len(receipts) != 0 {
+		t.Fatalf("expected genesis block without receipts before the first commit, got block %d with %d receipts", block.NumberU64(), len(receipts))
+	}
+	to := common.HexToAddress("0x0100000000000000000000000000000000000001")
+	var txs []*types.Transaction
+	for nonce := uint64(0); nonce < 2; nonce++ {
+		tx := signTx(t, types.NewTransaction(nonce, to, big.NewInt(1000), params.TxGas, big.NewInt(1), nil))
+		if err := sim.SendTransaction(context.Background(), tx); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	sim.Commit()
+
+	block, receipts := sim.LastCommitted()
+	if block.NumberU64() != 1 {
+		t.Errorf("expected block 1, got %d", block.NumberU64())
+	}
+	if len(block.Transactions()) != len(txs) || len(receipts) != len(txs) {
+		t.Fatalf("expected %d transactions and receipts, got %d and %d", len(txs), len(block.Transactions()), len(receipts))
+	}
+	for i, tx := range txs {
+		if block.Transactions()[i].Hash() != tx.Hash() {
+			t.Errorf("transaction %d: hash mismatch", i)
+		}
+		if receipts[i].TxHash != tx.Hash() {
+			t.Errorf("receipt %d: transaction hash mismatch", i)
+		}
+		if receipts[i].Status != types.ReceiptStatusSuccessful {
+			t.Errorf("receipt %d: unexpected status %d", i, receipts[i].Status)
+		}
+	}
+	// The pending block is reset, but the committed one is still accessible
+	sim.Commit()
+	if block, receipts := sim.LastCommitted(); block.NumberU64() != 2 || len(receipts) != 0 {
+		t.Errorf("expected empty block 2, got block %d with %d receipts", block.NumberU64(), len(receipts))
+	}
+}
+
+func TestAddUncle(t *testing.T) {
+	sim := newTestBackend()
+	genesis, _ := sim.LastCommitted()
+	sim.Commit()
+
+	uncleCoinbase := common.HexToAddress("0x0300000000000000000000000000000000000003")
+	time := new(big.Int).Add(genesis.Time(), big.NewInt(5))
+	uncle := &types.Header{
+		ParentHash:  genesis.Hash(),
+		UncleHash:   types.EmptyUncleHash,
+		Coinbase:    uncleCoinbase,
+		Root:        genesis.Root(),
+		TxHash:      types.EmptyRootHash,
+		ReceiptHash: types.EmptyRootHash,
+		Difficulty:  ethash.CalcDifficulty(params.AllEthashProtocolChanges, time.Uint64(), genesis.Header()),
+		Number:      big.NewInt(1),
+		GasLimit:    genesis.GasLimit(),
+		Time:        time,
+	}
+	wrongDifficulty := types.CopyHeader(uncle)
+	wrongDifficulty.Difficulty = new(big.Int).Add(uncle.Difficulty, big.NewInt(1))
+	if err := sim.AddUncle(wrongDifficulty); err == nil {
+		t.Errorf("uncle with wrong difficulty accepted")
+	}
+	if err := sim.AddUncle(uncle); err != nil {
+		t.Fatalf("valid uncle rejected: %v", err)
+	}
+	sim.Commit()
+
+	block, _ := sim.LastCommitted()
+	if len(block.Uncles()) != 1 || block.Uncles()[0].Hash() != uncle.Hash() {
+		t.Fatalf("expected the uncle to be included in block %d", block.NumberU64())
+	}
+	// Uncle at height 1 included at height 2 is rewarded with 7/8 of the block reward
+	expected := new(big.Int).Mul(ethash.ConstantinopleBlockReward, big.NewInt(7))
+	expected.Div(expected, big.NewInt(8))
+	balance, err := sim.BalanceAt(context.Background(), uncleCoinbase, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Cmp(expected) != 0 {
+		t.Errorf("wrong uncle reward: got %s, want %s", balance, expected)
+	}
+	// The same uncle can not be included again
+	if err := sim.AddUncle(uncle); err == nil {
+		t.Errorf("uncle included twice")
+	}
+}
+
+func TestTransactionByHash(t *testing.T) {
+	sim := newTestBackend()
+	ctx := context.Background()
+	to := common.HexToAddress("0x0100000000000000000000000000000000000001")
+
+	committed := signTx(t, types.NewTransaction(0, to, big.NewInt(1000), params.TxGas, big.NewInt(1), nil))
+	if err := sim.SendTransaction(ctx, committed); err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	pending := signTx(t, types.NewTransaction(1, to, big.NewInt(1000), params.TxGas, big.NewInt(1), nil))
+	if err := sim.SendTransaction(ctx, pending); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := sim.LastCommitted()
+
+	tx, blockHash, blockNumber, index, isPending, err := sim.TransactionByHash(ctx, committed.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Hash() != committed.Hash() || isPending {
+		t.Errorf("wrong committed transaction %x, pending %t", tx.Hash(), isPending)
+	}
+	if blockHash != block.Hash() || blockNumber != block.NumberU64() || index != 0 {
+		t.Errorf("wrong location of committed transaction: block %x (%d), index %d", blockHash, blockNumber, index)
+	}
+
+	tx, blockHash, blockNumber, index, isPending, err = sim.TransactionByHash(ctx, pending.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Hash() != pending.Hash() || !isPending {
+		t.Errorf("wrong pending transaction %x, pending %t", tx.Hash(), isPending)
+	}
+	if blockHash != (common.Hash{}) || blockNumber != 0 || index != 0 {
+		t.Errorf("unexpected location of pending transaction: block %x (%d), index %d", blockHash, blockNumber, index)
+	}
+
+	if _, _, _, _, _, err := sim.TransactionByHash(ctx, common.HexToHash("0x01")); err != ethereum.NotFound {
+		t.Errorf("expected %v for unknown transaction, got %v", ethereum.NotFound, err)
+	}
+}
+
+func TestTransactionError(t *testing.T) {
+	loop := common.HexToAddress("0x0200000000000000000000000000000000000002")
+	revert := common.HexToAddress("0x0200000000000000000000000000000000000003")
+	invalid := common.HexToAddress("0x0200000000000000000000000000000000000004")
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		testAddr: {Balance: big.NewInt(10000000000)},
+		// JUMPDEST PUSH1 0 JUMP
+		loop: {Balance: new(big.Int), Code: common.FromHex("5b600056")},
+		// PUSH1 0 PUSH1 0 REVERT
+		revert:  {Balance: new(big.Int), Code: common.FromHex("60006000fd")},
+		invalid: {Balance: new(big.Int), Code: common.FromHex("fe")},
+	}, 10000000)
+	ctx := context.Background()
+	var txs []*types.Transaction
+	for i, to := range []common.Address{loop, revert, invalid, common.HexToAddress("0x01")} {
+		tx := signTx(t, types.NewTransaction(uint64(i), to, new(big.Int), 100000, big.NewInt(1), nil))
+		if err := sim.SendTransaction(ctx, tx); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	if _, err := sim.TransactionError(txs[0].Hash()); err != ethereum.NotFound {
+		t.Errorf("expected %v for a pending transaction, got %v", ethereum.NotFound, err)
+	}
+	sim.Commit()
+	_, receipts := sim.LastCommitted()
+	for i, expected := range []string{backends.TxErrorOutOfGas, backends.TxErrorRevert, backends.TxErrorInvalidOpcode, ""} {
+		category, err := sim.TransactionError(txs[i].Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if category != expected {
+			t.Errorf("transaction %d: expected %q, got %q", i, expected, category)
+		}
+		if failed := receipts[i].Status == types.ReceiptStatusFailed; failed != (expected != "") {
+			t.Errorf("transaction %d: wrong receipt status %d", i, receipts[i].Status)
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	chart "github.com/wcharczuk/go-chart"
 	"github.com/wcharczuk/go-chart/util"
 
+	"github.com/ledgerwatch/turbo-geth/cmd/internal/cmdutil"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
 	"github.com/ledgerwatch/turbo-geth/consensus/misc"
@@ -44,6 +45,7 @@ var reset = flag.Int("reset", -1, "reset to given block number")
 var rewind = flag.Int("rewind", 1, "rewind to given number of blocks")
 var block = flag.Int("block", 1, "specifies a block number for operation")
 var account = flag.String("account", "0x", "specifies account to investigate")
+var flushInterval = flag.Duration("flushinterval", 10*time.Minute, "commit the batch at least this often during long runs")
 
 func bucketList(db *bolt.DB) [][]byte {
 	bucketList := [][]byte{}
@@ -682,7 +684,10 @@ func execToBlock(block int) {
 	blockDb, err := ethdb.NewBoltDatabase("/Users/alexeyakhunov/Library/Ethereum/testnet/geth/chaindata")
 	//ethDb, err := ethdb.NewBoltDatabase("/home/akhounov/.ethereum/geth/chaindata")
 	check(err)
-	bcb, err := core.NewBlockChain(blockDb, nil, params.TestnetChainConfig, ethash.NewFaker(), vm.Config{}, nil)
+	genesis, err := cmdutil.GenesisFromDB(blockDb)
+	check(err)
+	chainConfig := genesis.Config
+	bcb, err := core.NewBlockChain(blockDb, nil, chainConfig, ethash.NewFaker(), vm.Config{}, nil)
 	check(err)
 	defer blockDb.Close()
 	os.Remove("statedb")
@@ -690,9 +695,9 @@ func execToBlock(block int) {
 	stateDb, err := ethdb.NewBoltDatabase("statedb")
 	check(err)
 	defer stateDb.Close()
-	_, _, _, err = core.SetupGenesisBlock(stateDb, core.DefaultTestnetGenesisBlock())
+	_, _, _, err = core.SetupGenesisBlock(stateDb, genesis)
 	check(err)
-	bc, err := core.NewBlockChain(stateDb, nil, params.TestnetChainConfig, ethash.NewFaker(), vm.Config{}, nil)
+	bc, err := core.NewBlockChain(stateDb, nil, chainConfig, ethash.NewFaker(), vm.Config{}, nil)
 	check(err)
 	bc.SetNoHistory(true)
 	blocks := types.Blocks{}
@@ -725,13 +730,15 @@ func extractTrie(block int) {
 	stateDb, err := ethdb.NewBoltDatabase("statedb")
 	check(err)
 	defer stateDb.Close()
-	bc, err := core.NewBlockChain(stateDb, nil, params.TestnetChainConfig, ethash.NewFaker(), vm.Config{}, nil)
+	chainConfig, err := cmdutil.ChainConfigFromDB(stateDb)
+	check(err)
+	bc, err := core.NewBlockChain(stateDb, nil, chainConfig, ethash.NewFaker(), vm.Config{}, nil)
 	check(err)
 	baseBlock := bc.GetBlockByNumber(uint64(block))
 	tds, err := state.NewTrieDbState(baseBlock.Root(), stateDb, baseBlock.NumberU64())
 	check(err)
 	startTime := time.Now()
-	tds.Rebuild()
+	check(tds.RebuildFlushing(100000))
 	fmt.Printf("Rebuld done in %v\n", time.Since(startTime))
 	rebuiltRoot, err := tds.TrieRoot()
 	check(err)
@@ -751,7 +758,9 @@ func testRewind(block, rewind int) {
 	//ethDb, err := ethdb.NewBoltDatabase("statedb")
 	check(err)
 	defer ethDb.Close()
-	bc, err := core.NewBlockChain(ethDb, nil, params.TestnetChainConfig, ethash.NewFaker(), vm.Config{}, nil)
+	chainConfig, err := cmdutil.ChainConfigFromDB(ethDb)
+	check(err)
+	bc, err := core.NewBlockChain(ethDb, nil, chainConfig, ethash.NewFaker(), vm.Config{}, nil)
 	check(err)
 	currentBlock := bc.CurrentBlock()
 	currentBlockNr := currentBlock.NumberU64()
@@ -818,7 +827,9 @@ func testStartup() {
 	ethDb, err := ethdb.NewBoltDatabase("/home/akhounov/.ethereum/geth/chaindata")
 	check(err)
 	defer ethDb.Close()
-	bc, err := core.NewBlockChain(ethDb, nil, params.MainnetChainConfig, ethash.NewFaker(), vm.Config{}, nil)
+	chainConfig, err := cmdutil.ChainConfigFromDB(ethDb)
+	check(err)
+	bc, err := core.NewBlockChain(ethDb, nil, chainConfig, ethash.NewFaker(), vm.Config{}, nil)
 	check(err)
 	currentBlock := bc.CurrentBlock()
 	currentBlockNr := currentBlock.NumberU64()
@@ -1001,6 +1012,8 @@ func upgradeBlocks() {
 	ethDb, err := ethdb.NewBoltDatabase("/home/akhounov/.ethereum/geth/chaindata")
 	check(err)
 	defer ethDb.Close()
+	chainConfig, err := cmdutil.ChainConfigFromDB(ethDb)
+	check(err)
 	start := []byte{}
 	var keys [][]byte
 	if err := ethDb.Walk([]byte("b"), start, 0, func(k, v []byte) (bool, error) {
@@ -1023,7 +1036,7 @@ func upgradeBlocks() {
 		}
 		body := new(types.Body)
 		blockNum := binary.BigEndian.Uint64(key[:8])
-		signer := types.MakeSigner(params.MainnetChainConfig, big.NewInt(int64(blockNum)))
+		signer := types.MakeSigner(chainConfig, big.NewInt(int64(blockNum)))
 		body.Senders = make([]common.Address, len(smallBody.Transactions))
 		for j, tx := range smallBody.Transactions {
 			addr, err := signer.Sender(tx)
@@ -1117,7 +1130,8 @@ func loadAccount() {
 	blockNr := uint64(*block)
 	blockSuffix := encodeTimestamp(blockNr)
 	accountBytes := common.FromHex(*account)
-	secKey := crypto.Keccak256(accountBytes)
+	addrHash := state.AddressHash(common.BytesToAddress(accountBytes))
+	secKey := addrHash[:]
 	accountData, err := ethDb.GetAsOf(state.AccountsBucket, state.AccountsHistoryBucket, secKey, blockNr+1)
 	check(err)
 	fmt.Printf("Account data: %x\n", accountData)
@@ -1371,11 +1385,13 @@ func repair() {
 	currentDb := ethdb.NewMemDatabase()
 	//check(err)
 	defer currentDb.Close()
+	genesis, err := cmdutil.GenesisFromDB(historyDb)
+	check(err)
 	if *block == 1 {
-		_, _, _, err = core.SetupGenesisBlock(currentDb, core.DefaultGenesisBlock())
+		_, _, _, err = core.SetupGenesisBlock(currentDb, genesis)
 		check(err)
 	}
-	chainConfig := params.MainnetChainConfig
+	chainConfig := genesis.Config
 	vmConfig := vm.Config{}
 	bc, err := core.NewBlockChain(historyDb, nil, chainConfig, ethash.NewFaker(), vmConfig, nil)
 	check(err)
@@ -1383,6 +1399,7 @@ func repair() {
 	interrupt := false
 	noopWriter := state.NewNoopWriter()
 	currentM := currentDb.NewBatch()
+	currentM.SetFlushPolicy(200000, *flushInterval)
 	dbstate := state.NewRepairDbState(currentM, historyDb, blockNum-1)
 	for !interrupt {
 		block := bc.GetBlockByNumber(blockNum)
@@ -1410,9 +1427,9 @@ func repair() {
 			panic(err)
 		}
 		dbstate.CheckKeys()
-		if currentM.BatchSize() >= 200000 {
-			_, err := currentM.Commit()
-			check(err)
+		committed, err := currentM.CommitIfNeeded()
+		check(err)
+		if committed {
 			dbstate.PruneTries()
 		}
 		blockNum++
@@ -1435,7 +1452,8 @@ func readAccount() {
 	ethDb, err := ethdb.NewBoltDatabase("statedb")
 	check(err)
 	accountBytes := common.FromHex(*account)
-	secKey := crypto.Keccak256(accountBytes)
+	addrHash := state.AddressHash(common.BytesToAddress(accountBytes))
+	secKey := addrHash[:]
 	v, _ := ethDb.Get(state.AccountsBucket, secKey)
 	fmt.Printf("%x:%x\n", secKey, v)
 }
@@ -0,0 +1,68 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package cmdutil contains helpers shared by the developer tools in cmd.
+package cmdutil
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// ChainConfigFromDB returns the chain config stored in the database under the
+// hash of the canonical genesis block, so that tools can work on any chain
+// without hardcoding its config.
+func ChainConfigFromDB(db ethdb.Getter) (*params.ChainConfig, error) {
+	genesisHash := rawdb.ReadCanonicalHash(db, 0)
+	if genesisHash == (common.Hash{}) {
+		return nil, fmt.Errorf("genesis block not found in the database")
+	}
+	config := rawdb.ReadChainConfig(db, genesisHash)
+	if config == nil {
+		return nil, fmt.Errorf("chain config not found for genesis %x", genesisHash)
+	}
+	return config, nil
+}
+
+// GenesisFromDB returns the genesis of the chain stored in the database, with the
+// chain config read from the database, so that tools can set up another database
+// for the same chain. The allocation of the genesis is not stored in the database,
+// so only the chains with a known genesis block are supported.
+func GenesisFromDB(db ethdb.Getter) (*core.Genesis, error) {
+	config, err := ChainConfigFromDB(db)
+	if err != nil {
+		return nil, err
+	}
+	genesisHash := rawdb.ReadCanonicalHash(db, 0)
+	var genesis *core.Genesis
+	switch genesisHash {
+	case params.MainnetGenesisHash:
+		genesis = core.DefaultGenesisBlock()
+	case params.TestnetGenesisHash:
+		genesis = core.DefaultTestnetGenesisBlock()
+	case params.RinkebyGenesisHash:
+		genesis = core.DefaultRinkebyGenesisBlock()
+	default:
+		return nil, fmt.Errorf("unknown genesis %x, its allocation cannot be read from the database", genesisHash)
+	}
+	genesis.Config = config
+	return genesis, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package cmdutil
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+func TestChainConfigFromDB(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	if _, err := ChainConfigFromDB(db); err == nil {
+		t.Errorf("expected an error for an empty database")
+	}
+	genesis := core.DefaultTestnetGenesisBlock().MustCommit(db)
+	config, err := ChainConfigFromDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, params.TestnetChainConfig) {
+		t.Errorf("wrong chain config: got %v, want %v", config, params.TestnetChainConfig)
+	}
+
+	// Genesis present, but without a stored config
+	db = ethdb.NewMemDatabase()
+	rawdb.WriteCanonicalHash(db, genesis.Hash(), 0)
+	if _, err := ChainConfigFromDB(db); err == nil {
+		t.Errorf("expected an error for a missing chain config")
+	}
+}
+
+func TestGenesisFromDB(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	expected := core.DefaultTestnetGenesisBlock().MustCommit(db)
+	genesis, err := GenesisFromDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(genesis.Config, params.TestnetChainConfig) {
+		t.Errorf("wrong chain config: got %v, want %v", genesis.Config, params.TestnetChainConfig)
+	}
+	// Genesis set up from the result is the same as in the database
+	if block := genesis.MustCommit(ethdb.NewMemDatabase()); block.Hash() != expected.Hash() {
+		t.Errorf("wrong genesis: got %x, want %x", block.Hash(), expected.Hash())
+	}
+
+	// Allocation of a custom genesis is not known
+	db = ethdb.NewMemDatabase()
+	(&core.Genesis{Config: params.TestChainConfig}).MustCommit(db)
+	if _, err := GenesisFromDB(db); err == nil {
+		t.Errorf("expected an error for an unknown genesis")
+	}
+}
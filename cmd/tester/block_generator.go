@@ -24,6 +24,7 @@ type BlockGenerator struct {
 	input               *os.File
 	genesisBlock        *types.Block
 	coinbaseKey         *ecdsa.PrivateKey
+	fundedKeys          []*ecdsa.PrivateKey
 	blockOffsetByHash   map[common.Hash]uint64
 	blockOffsetByNumber map[uint64]uint64
 	headersByHash       map[common.Hash]*types.Header
@@ -84,18 +85,43 @@ func randAddress(r *rand.Rand) common.Address {
 	return b
 }
 
-func NewBlockGenerator(outputFile string, initialHeight int) (*BlockGenerator, error) {
+// fundedBalance is the balance given in the genesis to each of the funded keys
+var fundedBalance = new(big.Int).Mul(big.NewInt(1000), big.NewInt(params.Ether))
+
+// genesisWithFundedKeys returns the mainnet genesis, with the accounts of the keys
+// added to the allocation, and the gas limit raised to fit their transactions into
+// the first blocks. Without the keys, it is the mainnet genesis itself.
+func genesisWithFundedKeys(fundedKeys []*ecdsa.PrivateKey) *core.Genesis {
+	genesis := core.DefaultGenesisBlock()
+	if len(fundedKeys) > 0 {
+		genesis.GasLimit = 8000000
+	}
+	for _, key := range fundedKeys {
+		genesis.Alloc[crypto.PubkeyToAddress(key.PublicKey)] = core.GenesisAccount{Balance: fundedBalance}
+	}
+	return genesis
+}
+
+// NewBlockGenerator generates the chain of initialHeight blocks on top of the mainnet
+// genesis and writes it into outputFile. If uncleFrequency is positive, every
+// uncleFrequency-th block includes an uncle, which is a sibling of its parent.
+// Every block includes a transfer from each of the fundedKeys, which are funded in
+// the genesis (and so make the genesis differ from the mainnet one). Without funded
+// keys, blocks include a transfer from the coinbase, funded by the mining rewards.
+// Transactions are signed with the signer of the chain config at the block number.
+func NewBlockGenerator(outputFile string, initialHeight int, uncleFrequency int, fundedKeys []*ecdsa.PrivateKey) (*BlockGenerator, error) {
 	output, err := os.OpenFile(outputFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 	defer output.Close()
 	db := ethdb.NewMemDatabase()
-	genesisBlock, _, tds, err := core.DefaultGenesisBlock().ToBlock(db)
+	genesisBlock, _, tds, err := genesisWithFundedKeys(fundedKeys).ToBlock(db)
 	if err != nil {
 		return nil, err
 	}
 	parent := genesisBlock
+	var grandParent *types.Block
 	extra := []byte("BlockGenerator")
 	coinbaseKey, err := crypto.GenerateKey()
 	if err != nil {
@@ -108,6 +134,7 @@ func NewBlockGenerator(outputFile string, initialHeight int) (*BlockGenerator, e
 	bg := &BlockGenerator{
 		genesisBlock:        genesisBlock,
 		coinbaseKey:         coinbaseKey,
+		fundedKeys:          fundedKeys,
 		blockOffsetByHash:   make(map[common.Hash]uint64),
 		blockOffsetByNumber: make(map[uint64]uint64),
 		headersByHash:       make(map[common.Hash]*types.Header),
@@ -116,8 +143,15 @@ func NewBlockGenerator(outputFile string, initialHeight int) (*BlockGenerator, e
 	bg.headersByHash[genesisBlock.Header().Hash()] = genesisBlock.Header()
 	bg.headersByNumber[0] = genesisBlock.Header()
 	r := rand.New(rand.NewSource(4589489854))
-	var nonce uint64        // nonce of the sender (coinbase)
-	amount := big.NewInt(1) // 1 wei
+	senders := fundedKeys
+	firstTxHeight := 1
+	if len(senders) == 0 {
+		// The coinbase has no funds until it mines the first block
+		senders = []*ecdsa.PrivateKey{coinbaseKey}
+		firstTxHeight = 2
+	}
+	nonces := make([]uint64, len(senders)) // nonces of the senders
+	amount := big.NewInt(1)                // 1 wei
 	gasPrice := big.NewInt(10000000)
 	engine := ethash.NewFullFaker()
 
@@ -140,36 +174,45 @@ func NewBlockGenerator(outputFile string, initialHeight int) (*BlockGenerator, e
 		signedTxs := []*types.Transaction{}
 		receipts := []*types.Receipt{}
 		usedGas := new(uint64)
-		if height > 1 && gasLimit >= 21000 {
-			signer := types.MakeSigner(chainConfig, big.NewInt(int64(height)))
+		if height >= firstTxHeight && gasLimit >= 21000 {
+			signer := types.MakeSigner(chainConfig, header.Number)
 			gp := new(core.GasPool).AddGas(header.GasLimit)
 			vmConfig := vm.Config{}
 
-			to := randAddress(r)
-			tx := types.NewTransaction(nonce, to, amount, 21000, gasPrice, []byte{})
-			signed_tx, err := types.SignTx(tx, signer, coinbaseKey)
-			if err != nil {
-				return nil, err
-			}
-			signedTxs = append(signedTxs, signed_tx)
-			receipt, _, err := core.ApplyTransaction(chainConfig, nil, &coinbase, gp, statedb, tds.TrieStateWriter(), header, signed_tx, usedGas, vmConfig)
-			if err != nil {
-				return nil, fmt.Errorf("tx %x failed: %v", signed_tx.Hash(), err)
-			}
-			if !chainConfig.IsByzantium(header.Number) {
-				rootHash, err := tds.TrieRoot()
+			for i, key := range senders {
+				if gp.Gas() < 21000 {
+					break
+				}
+				to := randAddress(r)
+				tx := types.NewTransaction(nonces[i], to, amount, 21000, gasPrice, []byte{})
+				signed_tx, err := types.SignTx(tx, signer, key)
 				if err != nil {
-					panic(fmt.Errorf("%x failed: %v", signed_tx.Hash(), err))
+					return nil, err
 				}
-				receipt.PostState = rootHash.Bytes()
+				signedTxs = append(signedTxs, signed_tx)
+				receipt, _, err := core.ApplyTransaction(chainConfig, nil, &coinbase, gp, statedb, tds.TrieStateWriter(), header, signed_tx, usedGas, vmConfig)
+				if err != nil {
+					return nil, fmt.Errorf("tx %x failed: %v", signed_tx.Hash(), err)
+				}
+				if !chainConfig.IsByzantium(header.Number) {
+					rootHash, err := tds.TrieRoot()
+					if err != nil {
+						panic(fmt.Errorf("%x failed: %v", signed_tx.Hash(), err))
+					}
+					receipt.PostState = rootHash.Bytes()
+				}
+				receipts = append(receipts, receipt)
+				nonces[i]++
 			}
-			receipts = append(receipts, receipt)
-			nonce++
 		} else {
 			fmt.Printf("Block %d: Gas limit too low for a transaction: %d\n", height, gasLimit)
 		}
 
-		if _, err := engine.Finalize(chainConfig, header, statedb, signedTxs, []*types.Header{}, receipts); err != nil {
+		uncles := []*types.Header{}
+		if uncleFrequency > 0 && height%uncleFrequency == 0 && grandParent != nil {
+			uncles = append(uncles, makeUncle(chainConfig, grandParent, parent, randAddress(r)))
+		}
+		if _, err := engine.Finalize(chainConfig, header, statedb, signedTxs, uncles, receipts); err != nil {
 			return nil, err
 		}
 
@@ -183,9 +226,10 @@ func NewBlockGenerator(outputFile string, initialHeight int) (*BlockGenerator, e
 		if err != nil {
 			return nil, err
 		}
-		// Generate an empty block
-		block := types.NewBlock(header, signedTxs, []*types.Header{}, receipts)
+		block := types.NewBlock(header, signedTxs, uncles, receipts)
 		//fmt.Printf("block hash for %d: %x\n", block.NumberU64(), block.Hash())
+		// The block starts at the current position of the output
+		offset := pos
 		if buffer, err := rlp.EncodeToBytes(block); err != nil {
 			return nil, err
 		} else {
@@ -196,9 +240,10 @@ func NewBlockGenerator(outputFile string, initialHeight int) (*BlockGenerator, e
 		hash := header.Hash()
 		bg.headersByHash[hash] = header
 		bg.headersByNumber[block.NumberU64()] = header
-		bg.blockOffsetByHash[hash] = pos
-		bg.blockOffsetByNumber[block.NumberU64()] = pos
+		bg.blockOffsetByHash[hash] = offset
+		bg.blockOffsetByNumber[block.NumberU64()] = offset
 		td = new(big.Int).Add(td, block.Difficulty())
+		grandParent = parent
 		parent = block
 	}
 	bg.lastBlock = parent
@@ -212,6 +257,25 @@ func NewBlockGenerator(outputFile string, initialHeight int) (*BlockGenerator, e
 	return bg, nil
 }
 
+// makeUncle creates a header that is a valid uncle for the child of parent: a sibling
+// of parent, with a different coinbase and a later timestamp
+func makeUncle(config *params.ChainConfig, grandParent, parent *types.Block, coinbase common.Address) *types.Header {
+	tstamp := parent.Time().Int64() + 1
+	return &types.Header{
+		ParentHash:  grandParent.Hash(),
+		UncleHash:   types.EmptyUncleHash,
+		Coinbase:    coinbase,
+		Root:        grandParent.Root(),
+		TxHash:      types.EmptyRootHash,
+		ReceiptHash: types.EmptyRootHash,
+		Difficulty:  ethash.CalcDifficulty(config, uint64(tstamp), grandParent.Header()),
+		Number:      new(big.Int).Set(parent.Number()),
+		GasLimit:    parent.GasLimit(),
+		Time:        big.NewInt(tstamp),
+		Extra:       []byte("BlockGeneratorUncle"),
+	}
+}
+
 // Creates a fork from the existing block generator
 func NewForkGenerator(base *BlockGenerator, outputFile string, forkBase int, forkHeight int) (*BlockGenerator, error) {
 	output, err := os.OpenFile(outputFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
@@ -220,7 +284,7 @@ func NewForkGenerator(base *BlockGenerator, outputFile string, forkBase int, for
 	}
 	defer output.Close()
 	db := ethdb.NewMemDatabase()
-	genesisBlock, _, tds, err := core.DefaultGenesisBlock().ToBlock(db)
+	genesisBlock, _, tds, err := genesisWithFundedKeys(base.fundedKeys).ToBlock(db)
 	if err != nil {
 		return nil, err
 	}
@@ -274,6 +338,8 @@ func NewForkGenerator(base *BlockGenerator, outputFile string, forkBase int, for
 		// Generate an empty block
 		block := types.NewBlock(header, []*types.Transaction{}, []*types.Header{}, []*types.Receipt{})
 		fmt.Printf("block hash for %d: %x\n", block.NumberU64(), block.Hash())
+		// The block starts at the current position of the output
+		offset := pos
 		if buffer, err := rlp.EncodeToBytes(block); err != nil {
 			return nil, err
 		} else {
@@ -284,8 +350,8 @@ func NewForkGenerator(base *BlockGenerator, outputFile string, forkBase int, for
 		hash := header.Hash()
 		bg.headersByHash[hash] = header
 		bg.headersByNumber[block.NumberU64()] = header
-		bg.blockOffsetByHash[hash] = pos
-		bg.blockOffsetByNumber[block.NumberU64()] = pos
+		bg.blockOffsetByHash[hash] = offset
+		bg.blockOffsetByNumber[block.NumberU64()] = offset
 		td = new(big.Int).Add(td, block.Difficulty())
 		parent = block
 	}
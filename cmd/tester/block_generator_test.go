@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+func TestBlockGeneratorUncles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bg, err := NewBlockGenerator(filepath.Join(dir, "blocks"), 10, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bg.Close()
+	var blocks types.Blocks
+	for number := uint64(1); number <= 10; number++ {
+		block, err := bg.GetBlockByNumber(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := bg.GetHeaderByNumber(number)
+		if number%3 != 0 {
+			if len(block.Uncles()) != 0 || header.UncleHash != types.EmptyUncleHash {
+				t.Errorf("block %d: unexpected uncles", number)
+			}
+		} else {
+			if len(block.Uncles()) != 1 {
+				t.Fatalf("block %d: expected 1 uncle, got %d", number, len(block.Uncles()))
+			}
+			uncle := block.Uncles()[0]
+			if header.UncleHash != types.CalcUncleHash(block.Uncles()) || header.UncleHash == types.EmptyUncleHash {
+				t.Errorf("block %d: wrong uncle hash %x", number, header.UncleHash)
+			}
+			if uncle.ParentHash != bg.GetHeaderByNumber(number-2).Hash() || uncle.Number.Uint64() != number-1 {
+				t.Errorf("block %d: uncle %d is not a sibling of the parent", number, uncle.Number)
+			}
+			if uncle.Hash() == header.ParentHash {
+				t.Errorf("block %d: uncle is the parent", number)
+			}
+		}
+		blocks = append(blocks, block)
+	}
+	// The uncles and their rewards must pass the validation of the full node
+	db := ethdb.NewMemDatabase()
+	core.DefaultGenesisBlock().MustCommit(db)
+	bc, err := core.NewBlockChain(db, nil, params.MainnetChainConfig, ethash.NewFaker(), vm.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Stop()
+	if _, err := bc.InsertChain(blocks); err != nil {
+		t.Fatalf("generated chain rejected: %v", err)
+	}
+}
+
+func TestBlockGeneratorFundedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < 2; i++ {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	bg, err := NewBlockGenerator(filepath.Join(dir, "blocks"), 3, 0, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bg.Close()
+	var blocks types.Blocks
+	for number := uint64(1); number <= 3; number++ {
+		block, err := bg.GetBlockByNumber(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(block.Transactions()) != len(keys) {
+			t.Fatalf("block %d: expected %d transactions, got %d", number, len(keys), len(block.Transactions()))
+		}
+		// Recover the senders the same way as upgradeBlocks does for Body.Senders
+		signer := types.MakeSigner(params.MainnetChainConfig, block.Number())
+		body := block.Body()
+		body.Senders = make([]common.Address, len(body.Transactions))
+		for i, tx := range body.Transactions {
+			sender, err := signer.Sender(tx)
+			if err != nil {
+				t.Fatalf("block %d, tx %d: sender recovery failed: %v", number, i, err)
+			}
+			body.Senders[i] = sender
+			if sender != crypto.PubkeyToAddress(keys[i].PublicKey) {
+				t.Errorf("block %d, tx %d: wrong sender %x", number, i, sender)
+			}
+			if tx.Nonce() != number-1 {
+				t.Errorf("block %d, tx %d: wrong nonce %d", number, i, tx.Nonce())
+			}
+		}
+		blocks = append(blocks, block)
+	}
+	db := ethdb.NewMemDatabase()
+	genesisWithFundedKeys(keys).MustCommit(db)
+	bc, err := core.NewBlockChain(db, nil, params.MainnetChainConfig, ethash.NewFaker(), vm.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Stop()
+	if _, err := bc.InsertChain(blocks); err != nil {
+		t.Fatalf("generated chain rejected: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/ledgerwatch/turbo-geth/p2p"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+)
+
+// sendRLP encodes val (for example, headers or block bodies) once and sends the
+// encoding to rw as a message with the given code. It returns the size of the
+// encoding, for the accounting of the served bytes.
+func sendRLP(rw p2p.MsgWriter, code uint64, val interface{}) (uint64, error) {
+	enc, err := rlp.EncodeToBytes(val)
+	if err != nil {
+		return 0, err
+	}
+	if err := rw.WriteMsg(p2p.Msg{Code: code, Size: uint32(len(enc)), Payload: bytes.NewReader(enc)}); err != nil {
+		return 0, err
+	}
+	return uint64(len(enc)), nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/eth"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/p2p"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+)
+
+func TestSendRLP(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	db := ethdb.NewMemDatabase()
+	gspec := &core.Genesis{
+		Config: params.TestChainConfig,
+		Alloc:  core.GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+	}
+	genesis := gspec.MustCommit(db)
+	signer := types.HomesteadSigner{}
+	blocks, _ := core.GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db, 2, func(i int, block *core.BlockGen) {
+		if i == 1 {
+			tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{1}, big.NewInt(1000), params.TxGas, nil, nil), signer, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block.AddTx(tx)
+			block.AddUncle(&types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Difficulty: big.NewInt(1), Time: big.NewInt(0)})
+		}
+	})
+	for _, block := range blocks {
+		for _, val := range []interface{}{block.Header(), block.Body(), []*types.Header{block.Header()}} {
+			enc, err := rlp.EncodeToBytes(val)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rw msgRecorder
+			size, err := sendRLP(&rw, eth.BlockBodiesMsg, val)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != uint64(len(enc)) {
+				t.Errorf("block %d: size mismatch for %T: got %d, want %d", block.NumberU64(), val, size, len(enc))
+			}
+			if len(rw.payloads) != 1 || rw.codes[0] != eth.BlockBodiesMsg || !bytes.Equal(rw.payloads[0], enc) {
+				t.Errorf("block %d: wrong message sent for %T", block.NumberU64(), val)
+			}
+		}
+	}
+}
+
+// msgRecorder is a p2p.MsgWriter keeping the codes and payloads of the messages
+type msgRecorder struct {
+	codes    []uint64
+	payloads [][]byte
+}
+
+func (r *msgRecorder) WriteMsg(msg p2p.Msg) error {
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if uint32(len(payload)) != msg.Size {
+		return fmt.Errorf("payload of %d bytes in a message of size %d", len(payload), msg.Size)
+	}
+	r.codes = append(r.codes, msg.Code)
+	r.payloads = append(r.payloads, payload)
+	return nil
+}
@@ -72,14 +72,14 @@ func tester(ctx *cli.Context) error {
 		panic(fmt.Sprintf("Could not parse the node info: %v", err))
 	}
 	fmt.Printf("Parsed node: %s, IP: %s\n", nodeToConnect, nodeToConnect.IP())
-	_, err = NewBlockGenerator("emptyblocks", 100)
+	_, err = NewBlockGenerator("emptyblocks", 100, 0, nil)
 	if err != nil {
 		return err
 	}
 	//fmt.Printf("%s %s\n", ctx.Args()[0], ctx.Args()[1])
 	tp := NewTesterProtocol()
 	//tp.blockFeeder, err = NewBlockAccessor(ctx.Args()[0]/*, ctx.Args()[1]*/)
-	blockGen, err := NewBlockGenerator("emptyblocks", 50000)
+	blockGen, err := NewBlockGenerator("emptyblocks", 50000, 0, nil)
 	defer blockGen.Close()
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create block generator: %v", err))
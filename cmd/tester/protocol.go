@@ -28,6 +28,7 @@ type TesterProtocol struct {
 	forkFeeder       BlockFeeder
 	blockMarkers     []uint64 // Bitmap to remember which blocks (or just header if the blocks are empty) have been sent already
 	// This is to prevent double counting them
+	servedBytes uint64 // Total size of the headers and bodies sent to the peer
 }
 
 func NewTesterProtocol() *TesterProtocol {
@@ -238,11 +239,13 @@ func (tp *TesterProtocol) handleGetBlockHeaderMsg(msg p2p.Msg, rw p2p.MsgReadWri
 			headers = append(headers, header)
 		}
 	}
-	if err := p2p.Send(rw, eth.BlockHeadersMsg, headers); err != nil {
+	size, err := sendRLP(rw, eth.BlockHeadersMsg, headers)
+	if err != nil {
 		fmt.Printf("Failed to send headers: %v\n", err)
 		return newEmptyBlocks, err
 	}
-	fmt.Printf("Sent %d headers, empty blocks so far %d\n", len(headers), newEmptyBlocks)
+	tp.servedBytes += size
+	fmt.Printf("Sent %d headers, empty blocks so far %d, bytes served %d\n", len(headers), newEmptyBlocks, tp.servedBytes)
 	return newEmptyBlocks, nil
 }
 
@@ -282,8 +285,13 @@ func (tp *TesterProtocol) handleGetBlockBodiesMsg(msg p2p.Msg, rw p2p.MsgReadWri
 			bodies = append(bodies, data)
 		}
 	}
-	p2p.Send(rw, eth.BlockBodiesMsg, bodies)
-	fmt.Printf("Sent %d bodies, total so far %d\n", len(bodies), newSentBlocks)
+	size, err := sendRLP(rw, eth.BlockBodiesMsg, bodies)
+	if err != nil {
+		fmt.Printf("Failed to send bodies: %v\n", err)
+		return newSentBlocks, err
+	}
+	tp.servedBytes += size
+	fmt.Printf("Sent %d bodies, total so far %d, bytes served %d\n", len(bodies), newSentBlocks, tp.servedBytes)
 	return newSentBlocks, nil
 }
 
@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"math/big"
 	"os"
+	"runtime"
 	"testing"
 
 	"github.com/ledgerwatch/turbo-geth/common"
@@ -32,6 +33,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/rlp"
 )
 
 func BenchmarkInsertChain_empty_memdb(b *testing.B) {
@@ -70,6 +72,12 @@ func BenchmarkInsertChain_ring1000_memdb(b *testing.B) {
 func BenchmarkInsertChain_ring1000_diskdb(b *testing.B) {
 	benchInsertChain(b, true, genTxRing(1000))
 }
+func BenchmarkInsertChain_1000_sequential(b *testing.B) {
+	benchInsertChainPrevalidation(b, 0)
+}
+func BenchmarkInsertChain_1000_prevalidation(b *testing.B) {
+	benchInsertChainPrevalidation(b, runtime.NumCPU())
+}
 
 var (
 	// This is the content of the genesis block used by the benchmarks.
@@ -91,6 +99,48 @@ func genValueTx(nbytes int) func(int, *BlockGen) {
 	}
 }
 
+// benchInsertChainPrevalidation imports 1000 blocks with 20 transactions each,
+// using the given number of prevalidation workers
+func benchInsertChainPrevalidation(b *testing.B, workers int) {
+	gspec := Genesis{
+		Config: params.TestChainConfig,
+		Alloc:  GenesisAlloc{benchRootAddr: {Balance: benchRootFunds}},
+	}
+	genDb := ethdb.NewMemDatabase()
+	genesis := gspec.MustCommit(genDb)
+	chain, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), genDb, 1000, func(i int, gen *BlockGen) {
+		for j := 0; j < 20; j++ {
+			tx, _ := types.SignTx(types.NewTransaction(gen.TxNonce(benchRootAddr), common.Address{}, big.NewInt(1), params.TxGas, nil, nil), types.HomesteadSigner{}, benchRootKey)
+			gen.AddTx(tx)
+		}
+	})
+	// Blocks are re-decoded for every import, so that no senders are cached
+	enc, err := rlp.EncodeToBytes(chain)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db := ethdb.NewMemDatabase()
+		gspec.MustCommit(db)
+		chainman, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil)
+		chainman.SetPrevalidationWorkers(workers)
+		var blocks types.Blocks
+		if err := rlp.DecodeBytes(enc, &blocks); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if n, err := chainman.InsertChain(blocks); err != nil {
+			b.Fatalf("insert error (block %d): %v\n", n, err)
+		}
+		b.StopTimer()
+		chainman.Stop()
+		b.StartTimer()
+	}
+}
+
 var (
 	ringKeys  = make([]*ecdsa.PrivateKey, 1000)
 	ringAddrs = make([]common.Address, len(ringKeys))
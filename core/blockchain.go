@@ -139,6 +139,8 @@ type BlockChain struct {
 	noHistory      bool
 	enableReceipts bool // Whether receipts need to be written to the database
 	resolveReads   bool
+	// Number of goroutines validating the blocks ahead of the state processing, 0 for none
+	prevalidationWorkers int
 }
 
 // NewBlockChain returns a fully initialised block chain using information
@@ -218,6 +220,14 @@ func (bc *BlockChain) SetResolveReads(rr bool) {
 	bc.resolveReads = rr
 }
 
+// SetPrevalidationWorkers makes InsertChain recover the transaction senders and
+// check the transaction and uncle roots of all inserted blocks on the given number
+// of goroutines, before the state transitions are applied (sequentially).
+// Zero disables the prevalidation, leaving the sender recovery to the background cacher.
+func (bc *BlockChain) SetPrevalidationWorkers(workers int) {
+	bc.prevalidationWorkers = workers
+}
+
 func (bc *BlockChain) EnableReceipts(er bool) {
 	bc.enableReceipts = er
 }
@@ -1026,6 +1036,42 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 	return n, err
 }
 
+// prevalidateBlocks runs the checks of the blocks that do not depend on their ancestors
+// or on the state on bc.prevalidationWorkers goroutines, and returns the results in
+// the order of the blocks. The transaction senders are recovered and cached in the process.
+func (bc *BlockChain) prevalidateBlocks(chain types.Blocks) []error {
+	errs := make([]error, len(chain))
+	next := int32(-1)
+	var wg sync.WaitGroup
+	for w := 0; w < bc.prevalidationWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(atomic.AddInt32(&next, 1)); i < len(chain); i = int(atomic.AddInt32(&next, 1)) {
+				errs[i] = prevalidateBlock(types.MakeSigner(bc.chainConfig, chain[i].Number()), chain[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func prevalidateBlock(signer types.Signer, block *types.Block) error {
+	header := block.Header()
+	if hash := types.CalcUncleHash(block.Uncles()); hash != header.UncleHash {
+		return fmt.Errorf("uncle root hash mismatch: have %x, want %x", hash, header.UncleHash)
+	}
+	if hash := types.DeriveSha(block.Transactions()); hash != header.TxHash {
+		return fmt.Errorf("transaction root hash mismatch: have %x, want %x", hash, header.TxHash)
+	}
+	for _, tx := range block.Transactions() {
+		if _, err := types.Sender(signer, tx); err != nil {
+			return fmt.Errorf("invalid transaction %x: %v", tx.Hash(), err)
+		}
+	}
+	return nil
+}
+
 // insertChain is the internal implementation of insertChain, which assumes that
 // 1) chains are contiguous, and 2) The chain mutex is held.
 //
@@ -1039,8 +1085,13 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, []
 	if atomic.LoadInt32(&bc.procInterrupt) == 1 {
 		return 0, nil, nil, nil
 	}
-	// Start a parallel signature recovery (signer will fluke on fork transition, minimal perf loss)
-	senderCacher.recoverFromBlocks(types.MakeSigner(bc.chainConfig, chain[0].Number()), chain)
+	var prevalidated []error
+	if bc.prevalidationWorkers > 0 {
+		prevalidated = bc.prevalidateBlocks(chain)
+	} else {
+		// Start a parallel signature recovery (signer will fluke on fork transition, minimal perf loss)
+		senderCacher.recoverFromBlocks(types.MakeSigner(bc.chainConfig, chain[0].Number()), chain)
+	}
 
 	// Start the parallel header verifier
 	headers := make([]*types.Header, len(chain))
@@ -1154,6 +1205,9 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, []
 		if i >= offset && k >= verifyFrom {
 			err = <-results
 		}
+		if err == nil && prevalidated != nil && i >= offset {
+			err = prevalidated[k]
+		}
 		if err == nil {
 			err = bc.Validator().ValidateBody(block)
 		}
@@ -1453,3 +1453,52 @@ func BenchmarkBlockChain_1x1000Executions(b *testing.B) {
 
 	benchmarkLargeNumberOfValueToNonexisting(b, numTxs, numBlocks, recipientFn, dataFn)
 }
+
+// Tests that the blocks are imported with the prevalidation enabled, and that the
+// prevalidation rejects a block with a wrong transaction root.
+func TestInsertChainPrevalidation(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		db      = ethdb.NewMemDatabase()
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+		}
+		genesis = gspec.MustCommit(db)
+		signer  = types.HomesteadSigner{}
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db.MemCopy(), 10, func(i int, block *BlockGen) {
+		for j := 0; j < 3; j++ {
+			tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x01}, big.NewInt(1000), params.TxGas, nil, nil), signer, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block.AddTx(tx)
+		}
+	})
+	// Drop one transaction from the body of the block 6
+	bad := blocks[5]
+	blocks[5] = types.NewBlockWithHeader(bad.Header()).WithBody(bad.Transactions()[1:], bad.Uncles())
+
+	blockchain, _ := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil)
+	defer blockchain.Stop()
+	blockchain.SetPrevalidationWorkers(4)
+
+	n, err := blockchain.InsertChain(blocks)
+	if err == nil {
+		t.Fatalf("expected an error importing a block with wrong transaction root")
+	}
+	if n != 5 {
+		t.Errorf("failed block index: have %d, want 5", n)
+	}
+	if head := blockchain.CurrentBlock().NumberU64(); head != 5 {
+		t.Errorf("head block: have %d, want 5", head)
+	}
+	// The valid blocks before the bad one are imported with the senders recovered
+	for _, tx := range blocks[4].Transactions() {
+		if from, err := types.Sender(signer, tx); err != nil || from != address {
+			t.Errorf("wrong sender of %x: %x, %v", tx.Hash(), from, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// RebuildHistory re-executes the canonical blocks of bc from the block from to
+// the block to (inclusive) on top of the state stored in db, recording the
+// change sets into the history buckets. This makes as-of queries and
+// GetModifiedAccounts work for a range that was imported without history.
+// The state in db must be the state as of the block from-1, so it cannot be run
+// on the database of a node that keeps the head state: such a node needs either
+// a second database holding the genesis state, or RebuildHistoryInPlace.
+// The state root after every block is checked against the root in its header.
+// The changes are committed in batches, on failure the error tells the last
+// block which history has been committed to db.
+func RebuildHistory(bc *BlockChain, db ethdb.Database, from, to uint64) error {
+	if from == 0 {
+		return fmt.Errorf("history can only be rebuilt from block 1 onwards")
+	}
+	if from > to {
+		return fmt.Errorf("invalid block range %d-%d", from, to)
+	}
+	parent := bc.GetBlockByNumber(from - 1)
+	if parent == nil {
+		return fmt.Errorf("block %d not found", from-1)
+	}
+	batch := db.NewBatch()
+	batch.SetFlushPolicy(100000, 0)
+	tds, err := state.NewTrieDbState(parent.Root(), batch, from-1)
+	if err != nil {
+		return err
+	}
+	committedNr := from - 1
+	fail := func(err error) error {
+		batch.Rollback()
+		return fmt.Errorf("%v, history is committed up to block %d", err, committedNr)
+	}
+	processor := NewStateProcessor(bc.Config(), bc, bc.Engine())
+	for blockNr := from; blockNr <= to; blockNr++ {
+		block := bc.GetBlockByNumber(blockNr)
+		if block == nil {
+			return fail(fmt.Errorf("block %d not found", blockNr))
+		}
+		statedb := state.New(tds)
+		if _, _, _, err = processor.Process(block, statedb, tds, bc.vmConfig); err != nil {
+			return fail(fmt.Errorf("executing block %d: %v", blockNr, err))
+		}
+		root, err := tds.TrieRoot()
+		if err != nil {
+			return fail(err)
+		}
+		if root != block.Root() {
+			return fail(fmt.Errorf("state root mismatch at block %d: have %x, want %x", blockNr, root, block.Root()))
+		}
+		tds.SetBlockNr(blockNr)
+		if err = statedb.Commit(bc.Config().IsEIP158(block.Number()), tds.DbStateWriter()); err != nil {
+			return fail(err)
+		}
+		committed, err := batch.CommitIfNeeded()
+		if err != nil {
+			return fail(err)
+		}
+		if committed {
+			committedNr = blockNr
+			log.Info("Rebuilt history", "block", blockNr)
+		}
+	}
+	if _, err = batch.Commit(); err != nil {
+		return fail(err)
+	}
+	log.Info("Rebuilt history", "block", to)
+	return nil
+}
+
+// RebuildHistoryInPlace rebuilds the history of the blocks from 1 to to
+// (inclusive) in db that keeps the head state, for example, the database of a
+// node running with SetNoHistory. The blocks are replayed from the genesis
+// state in a scratch in-memory database, and only the history buckets are
+// written into db, so the state in db is left untouched.
+func RebuildHistoryInPlace(bc *BlockChain, genesis *Genesis, db ethdb.Database, to uint64) error {
+	scratch := ethdb.NewMemDatabase()
+	defer scratch.Close()
+	block, _, err := genesis.Commit(scratch)
+	if err != nil {
+		return err
+	}
+	if block.Hash() != bc.Genesis().Hash() {
+		return fmt.Errorf("genesis mismatch: have %x, want %x", block.Hash(), bc.Genesis().Hash())
+	}
+	if err = RebuildHistory(bc, scratch, 1, to); err != nil {
+		return err
+	}
+	batch := db.NewBatch()
+	for _, bucket := range [][]byte{state.AccountsHistoryBucket, state.StorageHistoryBucket, ethdb.SuffixBucket} {
+		if err = scratch.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			if err := batch.Put(bucket, common.CopyBytes(k), common.CopyBytes(v)); err != nil {
+				return false, err
+			}
+			_, err := batch.CommitIfNeeded()
+			return err == nil, err
+		}); err != nil {
+			batch.Rollback()
+			return err
+		}
+	}
+	_, err = batch.Commit()
+	return err
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+func TestRebuildHistory(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	gspec := &Genesis{
+		Config: params.TestChainConfig,
+		Alloc:  GenesisAlloc{address: {Balance: big.NewInt(1000000000)}},
+	}
+	genDb := ethdb.NewMemDatabase()
+	genesis := gspec.MustCommit(genDb)
+	recipients := make([]common.Address, 5)
+	for i := range recipients {
+		recipients[i] = common.BytesToAddress([]byte{0x10, byte(i)})
+	}
+	signer := types.MakeSigner(gspec.Config, big.NewInt(1))
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), genDb, len(recipients), func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), recipients[i], big.NewInt(1000), params.TxGas, nil, nil), signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.AddTx(tx)
+	})
+
+	// Chain imported without history only keeps the headers, the bodies are written separately
+	db := ethdb.NewMemDatabase()
+	gspec.MustCommit(db)
+	bc, err := NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Stop()
+	bc.SetNoHistory(true)
+	if _, err = bc.InsertChain(blocks); err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks {
+		rawdb.WriteBlock(db, block)
+	}
+	if accounts, err := ethdb.GetModifiedAccounts(db, 1, 5); err != nil || len(accounts) != 0 {
+		t.Fatalf("expected no modified accounts without history, got %x, err %v", accounts, err)
+	}
+
+	// The state in the database is the state at the head, not before the block 1
+	if err = RebuildHistory(bc, db, 1, 5); err == nil {
+		t.Fatal("expected an error for the state that does not match the parent block")
+	}
+
+	// A second database holding the genesis state gets the history of the whole range
+	historyDb := ethdb.NewMemDatabase()
+	gspec.MustCommit(historyDb)
+	if err = RebuildHistory(bc, historyDb, 1, 5); err != nil {
+		t.Fatal(err)
+	}
+	checkRebuiltHistory(t, historyDb, address, recipients)
+
+	// The database with the head state gets the history without touching the state
+	headRoot := bc.CurrentBlock().Root()
+	if err = RebuildHistoryInPlace(bc, gspec, db, 5); err != nil {
+		t.Fatal(err)
+	}
+	checkRebuiltHistory(t, db, address, recipients)
+	tds, err := state.NewTrieDbState(headRoot, db, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root, err := tds.TrieRoot(); err != nil || root != headRoot {
+		t.Errorf("expected the head state root %x, got %x, err %v", headRoot, root, err)
+	}
+}
+
+func checkRebuiltHistory(t *testing.T, db ethdb.Database, address common.Address, recipients []common.Address) {
+	t.Helper()
+	for i, recipient := range recipients {
+		blockNr := uint64(i + 1)
+		accounts, err := ethdb.GetModifiedAccounts(db, blockNr, blockNr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modified := make(map[common.Address]bool)
+		for _, account := range accounts {
+			modified[account] = true
+		}
+		if !modified[recipient] || !modified[address] {
+			t.Errorf("block %d: expected recipient %x and sender %x among modified accounts %x", blockNr, recipient, address, accounts)
+		}
+		for j, other := range recipients {
+			if j != i && modified[other] {
+				t.Errorf("block %d: unexpected modified account %x", blockNr, other)
+			}
+		}
+	}
+	// As-of queries see the recipient only after the transfer to it
+	if account, err := state.NewDbState(db, 2).ReadAccountData(recipients[2]); err != nil || account != nil {
+		t.Errorf("expected no account before the transfer, got %v, err %v", account, err)
+	}
+	if account, err := state.NewDbState(db, 3).ReadAccountData(recipients[2]); err != nil || account == nil || account.Balance.Int64() != 1000 {
+		t.Errorf("expected balance 1000 after the transfer, got %v, err %v", account, err)
+	}
+}
@@ -19,6 +19,7 @@ package rawdb
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math/big"
 
 	"github.com/ledgerwatch/turbo-geth/common"
@@ -344,6 +345,32 @@ func ReadBlock(db DatabaseReader, hash common.Hash, number uint64) *types.Block
 	return types.NewBlockWithHeader(header).WithBody(body.Transactions, body.Uncles)
 }
 
+// FindBlockGaps returns the ranges [first, last] of block numbers within [from, to]
+// for which the canonical block is missing, either because there is no canonical
+// hash for the number, or because the header or the body of the block is absent.
+func FindBlockGaps(db DatabaseReader, from, to uint64) ([][2]uint64, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid block range [%d, %d]", from, to)
+	}
+	var gaps [][2]uint64
+	inGap := false
+	for number := from; ; number++ {
+		hash := ReadCanonicalHash(db, number)
+		missing := hash == (common.Hash{}) || !HasHeader(db, hash, number) || !HasBody(db, hash, number)
+		if missing && !inGap {
+			gaps = append(gaps, [2]uint64{number, number})
+		}
+		if missing {
+			gaps[len(gaps)-1][1] = number
+		}
+		inGap = missing
+		if number == to {
+			break
+		}
+	}
+	return gaps, nil
+}
+
 // WriteBlock serializes a block into the database, header and body separately.
 func WriteBlock(db DatabaseWriter, block *types.Block) {
 	WriteBody(db, block.Hash(), block.NumberU64(), block.Body())
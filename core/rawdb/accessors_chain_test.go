@@ -317,3 +317,44 @@ func TestBlockReceiptStorage(t *testing.T) {
 		t.Fatalf("deleted receipts returned: %v", rs)
 	}
 }
+
+// Tests that the ranges of missing canonical blocks are detected.
+func TestFindBlockGaps(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	for i := uint64(0); i <= 15; i++ {
+		block := types.NewBlockWithHeader(&types.Header{
+			Number:      new(big.Int).SetUint64(i),
+			Extra:       []byte("test block"),
+			UncleHash:   types.EmptyUncleHash,
+			TxHash:      types.EmptyRootHash,
+			ReceiptHash: types.EmptyRootHash,
+		})
+		switch {
+		case i >= 5 && i <= 7:
+			continue
+		case i == 12:
+			// Canonical hash without the body
+			WriteHeader(db, block.Header())
+		default:
+			WriteBlock(db, block)
+		}
+		WriteCanonicalHash(db, block.Hash(), i)
+	}
+	gaps, err := FindBlockGaps(db, 0, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 2 || gaps[0] != [2]uint64{5, 7} || gaps[1] != [2]uint64{12, 12} {
+		t.Errorf("wrong gaps: %v", gaps)
+	}
+	// Gaps are clipped to the requested range
+	if gaps, _ := FindBlockGaps(db, 6, 20); len(gaps) != 3 || gaps[0] != [2]uint64{6, 7} || gaps[2] != [2]uint64{16, 20} {
+		t.Errorf("wrong gaps in the partial range: %v", gaps)
+	}
+	if gaps, _ := FindBlockGaps(db, 8, 11); len(gaps) != 0 {
+		t.Errorf("unexpected gaps: %v", gaps)
+	}
+	if _, err := FindBlockGaps(db, 2, 1); err == nil {
+		t.Errorf("expected an error for an invalid range")
+	}
+}
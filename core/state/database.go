@@ -24,6 +24,7 @@ import (
 	"math/big"
 	"runtime"
 	"sort"
+	"sync"
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
@@ -38,9 +39,9 @@ import (
 var MaxTrieCacheGen = uint32(4 * 1024 * 1024)
 
 var AccountsBucket = []byte("AT")
-var AccountsHistoryBucket = []byte("hAT")
+var AccountsHistoryBucket = ethdb.HistoryBucket(AccountsBucket)
 var StorageBucket = []byte("ST")
-var StorageHistoryBucket = []byte("hST")
+var StorageHistoryBucket = ethdb.HistoryBucket(StorageBucket)
 var CodeBucket = []byte("CODE")
 
 const (
@@ -78,12 +79,32 @@ type hasher struct {
 	sha keccakState
 }
 
-var hasherPool = make(chan *hasher, 128)
+// hasherPool keeps idle hashers for reuse. Every hasher owns its keccak state,
+// and is only used by the goroutine that took it from the pool until it is returned
+var (
+	hasherPool   = make(chan *hasher, 128)
+	hasherPoolMu sync.RWMutex // Guards the replacement of hasherPool
+)
+
+// SetHasherPoolSize changes the number of idle hashers kept for reuse. Bigger pools
+// reduce allocations when the state is read from many goroutines in parallel.
+// Hashers idle in the previous pool are dropped.
+func SetHasherPoolSize(size int) {
+	hasherPoolMu.Lock()
+	defer hasherPoolMu.Unlock()
+	hasherPool = make(chan *hasher, size)
+}
+
+func currentHasherPool() chan *hasher {
+	hasherPoolMu.RLock()
+	defer hasherPoolMu.RUnlock()
+	return hasherPool
+}
 
 func newHasher() *hasher {
 	var h *hasher
 	select {
-	case h = <-hasherPool:
+	case h = <-currentHasherPool():
 	default:
 		h = &hasher{sha: sha3.NewLegacyKeccak256().(keccakState)}
 	}
@@ -92,12 +113,24 @@ func newHasher() *hasher {
 
 func returnHasherToPool(h *hasher) {
 	select {
-	case hasherPool <- h:
+	case currentHasherPool() <- h:
 	default:
-		fmt.Printf("Allowing hasher to be garbage collected, pool is full\n")
+		// Pool is full, allow the hasher to be garbage collected
 	}
 }
 
+// AddressHash returns the keccak hash of the address, which is the key of the
+// account in the AccountsBucket and in the AccountsHistoryBucket.
+func AddressHash(address common.Address) common.Hash {
+	h := newHasher()
+	defer returnHasherToPool(h)
+	h.sha.Reset()
+	h.sha.Write(address[:])
+	var buf common.Hash
+	h.sha.Read(buf[:])
+	return buf
+}
+
 type NoopWriter struct {
 }
 
@@ -257,6 +290,16 @@ func (tds *TrieDbState) AccountTrie() *trie.Trie {
 	return tds.t
 }
 
+// StorageTrie returns the storage trie of the given account, creating it from the
+// storage root of the account if it has not been loaded yet.
+func (tds *TrieDbState) StorageTrie(address common.Address) (*trie.Trie, error) {
+	addrHash, err := tds.HashAddress(&address, false /*save*/)
+	if err != nil {
+		return nil, err
+	}
+	return tds.getStorageTrie(address, addrHash, true)
+}
+
 func (tds *TrieDbState) TrieRoot() (common.Hash, error) {
 	root, err := tds.trieRoot(true)
 	tds.clearUpdates()
@@ -683,6 +726,20 @@ func (tds *TrieDbState) Rebuild() {
 	tr.Rebuild(tds.db, tds.blockNr)
 }
 
+// RebuildFlushing is a variant of Rebuild for large states that keeps the memory
+// bounded. Hashes of the intermediate subtries are written into the database
+// in batches of up to batchSize entries (see trie.RebuildFlushing).
+func (tds *TrieDbState) RebuildFlushing(batchSize int) error {
+	batch := tds.db.NewBatch()
+	batch.SetFlushPolicy(batchSize, 0)
+	if _, err := tds.AccountTrie().RebuildFlushing(tds.db, batch, tds.blockNr); err != nil {
+		batch.Rollback()
+		return err
+	}
+	_, err := batch.Commit()
+	return err
+}
+
 func (tds *TrieDbState) SetBlockNr(blockNr uint64) {
 	tds.blockNr = blockNr
 }
@@ -1401,6 +1458,9 @@ func (dsw *DbStateWriter) DeleteAccount(address common.Address, original *Accoun
 	if err := dsw.tds.db.Delete(AccountsBucket, addrHash[:]); err != nil {
 		return err
 	}
+	if err := dsw.clearStorage(address); err != nil {
+		return err
+	}
 	if dsw.tds.noHistory {
 		return nil
 	}
@@ -1417,6 +1477,32 @@ func (dsw *DbStateWriter) DeleteAccount(address common.Address, original *Accoun
 	return dsw.tds.db.PutS(AccountsHistoryBucket, addrHash[:], originalData, dsw.tds.blockNr)
 }
 
+// clearStorage removes all storage items of the deleted account, so that they do not
+// leak into the next incarnation of the account, if it gets recreated later. The
+// history records of the removed items keep them accessible as of the earlier blocks.
+func (dsw *DbStateWriter) clearStorage(address common.Address) error {
+	var keys, values [][]byte
+	if err := dsw.tds.db.Walk(StorageBucket, address[:], 8*common.AddressLength, func(k, v []byte) (bool, error) {
+		keys = append(keys, common.CopyBytes(k))
+		values = append(values, common.CopyBytes(v))
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if err := dsw.tds.db.Delete(StorageBucket, key); err != nil {
+			return err
+		}
+		if dsw.tds.noHistory {
+			continue
+		}
+		if err := dsw.tds.db.PutS(StorageHistoryBucket, key, values[i], dsw.tds.blockNr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (tsw *TrieStateWriter) UpdateAccountCode(codeHash common.Hash, code []byte) error {
 	if tsw.tds.resolveReads {
 		if _, ok := tsw.tds.createdCodes[codeHash]; !ok {
@@ -1512,7 +1598,7 @@ type Trie interface {
 	TryUpdate(db ethdb.Database, key, value []byte, blockNr uint64) error
 	TryDelete(db ethdb.Database, key []byte, blockNr uint64) error
 	Hash() common.Hash
-	NodeIterator(db ethdb.Database, startKey []byte, blockNr uint64) trie.NodeIterator
+	NodeIterator(db ethdb.Getter, startKey []byte, blockNr uint64) trie.NodeIterator
 	GetKey(trie.DatabaseReader, []byte) []byte // TODO(fjl): remove this when SecureTrie is removed
 }
 
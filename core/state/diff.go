@@ -0,0 +1,90 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// DiffRoots writes into w the differences between two account tries: the accounts
+// present only in the trie with root rootA, the accounts present only in the trie
+// with root rootB, and the accounts with different values. Each root is resolved
+// from the state as of its own block (rootA as of blockA, rootB as of blockB),
+// using the history. The tries are resolved on demand, and subtries with equal
+// hashes are skipped without being resolved.
+func DiffRoots(db ethdb.Getter, rootA common.Hash, blockA uint64, rootB common.Hash, blockB uint64, w io.Writer) error {
+	ta := trie.New(rootA, AccountsBucket, nil, false)
+	ta.SetHistorical(true)
+	tb := trie.New(rootB, AccountsBucket, nil, false)
+	tb.SetHistorical(true)
+	// Iterators over the leaves that are present only in one of the tries, or differ
+	diffA, _ := trie.NewDifferenceIterator(tb.NodeIterator(db, nil, blockB), ta.NodeIterator(db, nil, blockA))
+	diffB, _ := trie.NewDifferenceIterator(ta.NodeIterator(db, nil, blockA), tb.NodeIterator(db, nil, blockB))
+	itA, itB := trie.NewIterator(diffA), trie.NewIterator(diffB)
+	okA, okB := itA.Next(), itB.Next()
+	for okA || okB {
+		var c int
+		switch {
+		case !okA:
+			c = 1
+		case !okB:
+			c = -1
+		default:
+			c = bytes.Compare(itA.Key, itB.Key)
+		}
+		switch {
+		case c < 0:
+			fmt.Fprintf(w, "Only in A: %s %s\n", diffAddress(db, itA.Key), diffAccount(itA.Value))
+			okA = itA.Next()
+		case c > 0:
+			fmt.Fprintf(w, "Only in B: %s %s\n", diffAddress(db, itB.Key), diffAccount(itB.Value))
+			okB = itB.Next()
+		default:
+			fmt.Fprintf(w, "Different: %s A: %s B: %s\n", diffAddress(db, itA.Key), diffAccount(itA.Value), diffAccount(itB.Value))
+			okA, okB = itA.Next(), itB.Next()
+		}
+	}
+	if itA.Err != nil {
+		return fmt.Errorf("resolving trie %x: %v", rootA, itA.Err)
+	}
+	if itB.Err != nil {
+		return fmt.Errorf("resolving trie %x: %v", rootB, itB.Err)
+	}
+	return nil
+}
+
+// diffAddress returns the address with the given hash, or the hash if the preimage is unknown
+func diffAddress(db ethdb.Getter, addrHash []byte) string {
+	if preimage, err := db.Get(trie.SecureKeyPrefix, addrHash); err == nil && preimage != nil {
+		return fmt.Sprintf("%x", preimage)
+	}
+	return fmt.Sprintf("hash %x", addrHash)
+}
+
+func diffAccount(enc []byte) string {
+	account, err := encodingToAccount(enc)
+	if err != nil || account == nil {
+		return fmt.Sprintf("%x", enc)
+	}
+	return fmt.Sprintf("(nonce %d, balance %s, root %x, code hash %x)", account.Nonce, account.Balance, account.Root, account.CodeHash)
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestDiffRoots(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	addrs := make([]common.Address, 50)
+	for i := range addrs {
+		addrs[i] = common.BytesToAddress([]byte{0xa0, byte(i)})
+	}
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		for i, addr := range addrs {
+			s.SetBalance(addr, big.NewInt(int64(i+1)))
+		}
+	})
+	rootA, err := tds.TrieRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, changed, created := addrs[3], addrs[10], common.HexToAddress("0xb0")
+	commitBlock(t, tds, 2, func(s *StateDB) {
+		s.Suicide(deleted)
+		s.SetBalance(changed, big.NewInt(1000))
+		s.SetBalance(created, big.NewInt(7))
+	})
+	rootB, err := tds.TrieRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = DiffRoots(db, rootA, 1, rootB, 2, &buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 differences, got:\n%s", buf.String())
+	}
+	expected := map[string]string{
+		fmt.Sprintf("Only in A: %x (nonce 0, balance 4,", deleted):     "",
+		fmt.Sprintf("Only in B: %x (nonce 0, balance 7,", created):     "",
+		fmt.Sprintf("Different: %x A: (nonce 0, balance 11,", changed): "balance 1000",
+	}
+	for prefix, contains := range expected {
+		found := false
+		for _, line := range lines {
+			if strings.HasPrefix(line, prefix) && strings.Contains(line, contains) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no line starting with %q in:\n%s", prefix, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err = DiffRoots(db, rootB, 2, rootB, 2, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no differences between equal roots, got:\n%s", buf.String())
+	}
+
+	// Neither of the roots is the head of the state any more
+	commitBlock(t, tds, 3, func(s *StateDB) {
+		for _, addr := range addrs[20:30] {
+			s.SetBalance(addr, big.NewInt(5000))
+		}
+	})
+	buf.Reset()
+	if err = DiffRoots(db, rootB, 2, rootA, 1, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{
+		fmt.Sprintf("Only in A: %x (nonce 0, balance 7,", created):       "",
+		fmt.Sprintf("Only in B: %x (nonce 0, balance 4,", deleted):       "",
+		fmt.Sprintf("Different: %x A: (nonce 0, balance 1000,", changed): "balance 11,",
+	}
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 differences between the past roots, got:\n%s", buf.String())
+	}
+	for prefix, contains := range expected {
+		found := false
+		for _, line := range lines {
+			if strings.HasPrefix(line, prefix) && strings.Contains(line, contains) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no line starting with %q in:\n%s", prefix, buf.String())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// DumpAccountHistory writes into w one line for every block at which the data
+// of the given account changed, together with the account as it was right after
+// that block. The changes are taken from the AccountsHistoryBucket.
+func DumpAccountHistory(db ethdb.Getter, address common.Address, w io.Writer) error {
+	addrHash := AddressHash(address)
+	var blockNrs []uint64
+	// History records contain the value of the account before the change
+	var values [][]byte
+	if err := db.Walk(AccountsHistoryBucket, addrHash[:], 8*common.HashLength, func(k, v []byte) (bool, error) {
+		blockNr, _ := ethdb.DecodeTimestamp(k[common.HashLength:])
+		blockNrs = append(blockNrs, blockNr)
+		values = append(values, common.CopyBytes(v))
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for i, blockNr := range blockNrs {
+		// The value after the change is the value before the next change,
+		// or the current value for the last change
+		var enc []byte
+		if i+1 < len(values) {
+			enc = values[i+1]
+		} else if v, err := db.Get(AccountsBucket, addrHash[:]); err == nil {
+			enc = v
+		}
+		account, err := encodingToAccount(enc)
+		if err != nil {
+			return fmt.Errorf("decoding account %x at block %d: %v", address, blockNr, err)
+		}
+		if account == nil {
+			fmt.Fprintf(w, "Block %d: deleted\n", blockNr)
+			continue
+		}
+		fmt.Fprintf(w, "Block %d: nonce %d, balance %s, root %x, code hash %x\n",
+			blockNr, account.Nonce, account.Balance, account.Root, account.CodeHash)
+	}
+	return nil
+}
+
+// CodeChangeBlocks returns the blocks between from and to (inclusive) at which the
+// code hash of the given account changed, for example, when a contract was
+// created, destroyed or recreated with a different code at the same address.
+func CodeChangeBlocks(db ethdb.Getter, address common.Address, from, to uint64) ([]uint64, error) {
+	addrHash := AddressHash(address)
+	var blockNrs []uint64
+	// History records contain the value of the account before the change
+	var values [][]byte
+	startkey := append(common.CopyBytes(addrHash[:]), encodeTimestamp(from)...)
+	if err := db.Walk(AccountsHistoryBucket, startkey, 8*common.HashLength, func(k, v []byte) (bool, error) {
+		blockNr, _ := ethdb.DecodeTimestamp(k[common.HashLength:])
+		blockNrs = append(blockNrs, blockNr)
+		values = append(values, common.CopyBytes(v))
+		// The first change after the range is only needed for the value after the last change in it
+		return blockNr <= to, nil
+	}); err != nil {
+		return nil, err
+	}
+	var changed []uint64
+	for i, blockNr := range blockNrs {
+		if blockNr > to {
+			break
+		}
+		var enc []byte
+		if i+1 < len(values) {
+			enc = values[i+1]
+		} else if v, err := db.Get(AccountsBucket, addrHash[:]); err == nil {
+			enc = v
+		}
+		before, err := codeHashOf(values[i])
+		if err != nil {
+			return nil, fmt.Errorf("decoding account %x before block %d: %v", address, blockNr, err)
+		}
+		after, err := codeHashOf(enc)
+		if err != nil {
+			return nil, fmt.Errorf("decoding account %x at block %d: %v", address, blockNr, err)
+		}
+		if before != after {
+			changed = append(changed, blockNr)
+		}
+	}
+	return changed, nil
+}
+
+// codeHashOf returns the code hash of the encoded account, which is the hash of
+// the empty code for an account that does not exist
+func codeHashOf(enc []byte) (common.Hash, error) {
+	account, err := encodingToAccount(enc)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if account == nil {
+		return emptyCodeHashH, nil
+	}
+	return common.BytesToHash(account.CodeHash), nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestDumpAccountHistory(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	addr := common.HexToAddress("0x1234")
+	other := common.HexToAddress("0x5678")
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		s.SetBalance(addr, big.NewInt(100))
+	})
+	commitBlock(t, tds, 2, func(s *StateDB) {
+		// Block that does not touch addr
+		s.SetBalance(other, big.NewInt(1))
+	})
+	commitBlock(t, tds, 3, func(s *StateDB) {
+		s.SetBalance(addr, big.NewInt(200))
+		s.SetNonce(addr, 1)
+	})
+	commitBlock(t, tds, 5, func(s *StateDB) {
+		s.SetNonce(addr, 2)
+	})
+	var buf bytes.Buffer
+	if err := DumpAccountHistory(db, addr, &buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := []string{
+		"Block 1: nonce 0, balance 100,",
+		"Block 3: nonce 1, balance 200,",
+		"Block 5: nonce 2, balance 200,",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d:\n%s", len(expected), len(lines), buf.String())
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("line %d: expected prefix %q, got %q", i, prefix, lines[i])
+		}
+	}
+	if !strings.Contains(lines[0], fmt.Sprintf("code hash %x", emptyCodeHash)) {
+		t.Errorf("expected empty code hash in %q", lines[0])
+	}
+
+	buf.Reset()
+	if err := DumpAccountHistory(db, common.HexToAddress("0x9999"), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected empty dump for unknown account, got %q", buf.String())
+	}
+}
+
+func TestCodeChangeBlocks(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	addr := common.HexToAddress("0x1234")
+	commitBlock(t, tds, 2, func(s *StateDB) {
+		s.SetBalance(addr, big.NewInt(1))
+	})
+	commitBlock(t, tds, 4, func(s *StateDB) {
+		s.SetCode(addr, []byte{0x01})
+	})
+	commitBlock(t, tds, 6, func(s *StateDB) {
+		// Change that keeps the code
+		s.SetBalance(addr, big.NewInt(2))
+	})
+	commitBlock(t, tds, 9, func(s *StateDB) {
+		s.SetCode(addr, []byte{0x02})
+	})
+	commitBlock(t, tds, 10, func(s *StateDB) {
+		s.SetNonce(addr, 1)
+	})
+	for _, test := range []struct {
+		from, to uint64
+		expected []uint64
+	}{
+		{0, 10, []uint64{4, 9}},
+		{4, 9, []uint64{4, 9}},
+		{5, 10, []uint64{9}},
+		{1, 8, []uint64{4}},
+		{5, 8, nil},
+	} {
+		changed, err := CodeChangeBlocks(db, addr, test.from, test.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(changed) != fmt.Sprint(test.expected) {
+			t.Errorf("blocks %d-%d: got %v, expected %v", test.from, test.to, changed, test.expected)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package state
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
@@ -55,6 +56,14 @@ func (dbs *DbState) SetBlockNr(blockNr uint64) {
 }
 
 func (dbs *DbState) ForEachStorage(addr common.Address, start []byte, cb func(key, seckey, value common.Hash) bool, maxResults int) {
+	if err := dbs.WalkStorage(addr, start, cb, maxResults); err != nil {
+		log.Error("Error walking storage", "address", addr, "err", err)
+	}
+}
+
+// WalkStorage is ForEachStorage that reports the failures of reading the storage
+// from the database. When the reading fails, cb is not invoked.
+func (dbs *DbState) WalkStorage(addr common.Address, start []byte, cb func(key, seckey, value common.Hash) bool, maxResults int) error {
 	st := llrb.New()
 	var s [20 + 32]byte
 	copy(s[:], addr[:])
@@ -76,7 +85,7 @@ func (dbs *DbState) ForEachStorage(addr common.Address, start []byte, cb func(ke
 		})
 	}
 	numDeletes := st.Len() - overrideCounter
-	dbs.db.WalkAsOf(StorageBucket, StorageHistoryBucket, s[:], 0, dbs.blockNr+1, func(ks, vs []byte) (bool, error) {
+	if err := dbs.db.WalkAsOf(StorageBucket, StorageHistoryBucket, s[:], 0, dbs.blockNr+1, func(ks, vs []byte) (bool, error) {
 		if !bytes.HasPrefix(ks, addr[:]) {
 			return false, nil
 		}
@@ -98,7 +107,9 @@ func (dbs *DbState) ForEachStorage(addr common.Address, start []byte, cb func(ke
 			return st.Len() < maxResults+numDeletes, nil
 		}
 		return st.Len() < maxResults+overrideCounter+numDeletes, nil
-	})
+	}); err != nil {
+		return err
+	}
 	results := 0
 	st.AscendGreaterOrEqual(min, func(i llrb.Item) bool {
 		item := i.(*storageItem)
@@ -117,16 +128,50 @@ func (dbs *DbState) ForEachStorage(addr common.Address, start []byte, cb func(ke
 		}
 		return results < maxResults
 	})
+	return nil
+}
+
+// StorageEntry is a single storage item of an account, as returned by StorageRange
+type StorageEntry struct {
+	Key    common.Hash // Preimage of SecKey, if known
+	SecKey common.Hash
+	Value  common.Hash
+}
+
+// StorageRange returns up to maxResults non-empty storage items of the account,
+// ordered by secure key and starting from the secure key start. If there are more
+// items, next is the secure key to pass as start to get the following page,
+// otherwise next is nil.
+func (dbs *DbState) StorageRange(addr common.Address, start []byte, maxResults int) (slots []StorageEntry, next []byte, err error) {
+	if maxResults <= 0 {
+		return nil, nil, fmt.Errorf("maxResults must be positive, got %d", maxResults)
+	}
+	// Ask for one more item to find out where the next page starts
+	if err := dbs.WalkStorage(addr, start, func(key, seckey, value common.Hash) bool {
+		if len(slots) < maxResults {
+			slots = append(slots, StorageEntry{Key: key, SecKey: seckey, Value: value})
+			return true
+		}
+		next = common.CopyBytes(seckey[:])
+		return false
+	}, maxResults+1); err != nil {
+		return nil, nil, err
+	}
+	return slots, next, nil
+}
+
+// StorageRootHash returns the root hash of the storage trie of the account as of
+// the block blockNr. Only the top of the storage trie is resolved from the
+// database, without reconstructing the whole trie in memory.
+func StorageRootHash(db ethdb.Getter, addr common.Address, blockNr uint64) (common.Hash, error) {
+	t := trie.New(common.Hash{}, StorageBucket, addr[:], true)
+	t.SetHistorical(true)
+	return t.ResolveRootHash(db, blockNr)
 }
 
 func (dbs *DbState) ReadAccountData(address common.Address) (*Account, error) {
-	h := newHasher()
-	defer returnHasherToPool(h)
-	h.sha.Reset()
-	h.sha.Write(address[:])
-	var buf common.Hash
-	h.sha.Read(buf[:])
-	enc, err := dbs.db.GetAsOf(AccountsBucket, AccountsHistoryBucket, buf[:], dbs.blockNr+1)
+	addrHash := AddressHash(address)
+	enc, err := dbs.db.GetAsOf(AccountsBucket, AccountsHistoryBucket, addrHash[:], dbs.blockNr+1)
 	if err != nil || enc == nil || len(enc) == 0 {
 		return nil, nil
 	}
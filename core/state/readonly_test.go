@@ -0,0 +1,358 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// commitBlock applies the modifications made by f to the state and writes them
+// into the database as the block blockNr
+func commitBlock(t *testing.T, tds *TrieDbState, blockNr uint64, f func(s *StateDB)) {
+	tds.SetBlockNr(blockNr - 1)
+	s := New(tds)
+	f(s)
+	if _, err := tds.IntermediateRoot(s, false); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(blockNr)
+	if err := s.Commit(false, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDbStateConcurrentReads(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	var addrs []common.Address
+	for i := 0; i < 64; i++ {
+		addrs = append(addrs, common.BytesToAddress([]byte{byte(i), 0x01}))
+	}
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		for i, addr := range addrs {
+			s.SetBalance(addr, big.NewInt(int64(i+1)))
+		}
+	})
+	dbs := NewDbState(db, 1)
+	var wg sync.WaitGroup
+	errs := make(chan error, 16*len(addrs))
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := range addrs {
+				i := (j + g) % len(addrs)
+				account, err := dbs.ReadAccountData(addrs[i])
+				if err != nil {
+					errs <- err
+					return
+				}
+				if account == nil || account.Balance.Int64() != int64(i+1) {
+					errs <- fmt.Errorf("wrong account for %x: %v", addrs[i], account)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStorageRange(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	addr := common.HexToAddress("0x1234")
+	other := common.HexToAddress("0x1235")
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		s.SetBalance(addr, big.NewInt(1))
+		s.SetBalance(other, big.NewInt(1))
+		for i := 1; i <= 10; i++ {
+			s.SetState(addr, common.BigToHash(big.NewInt(int64(i))), common.BigToHash(big.NewInt(int64(100+i))))
+		}
+		s.SetState(other, common.Hash{}, common.BigToHash(big.NewInt(1)))
+	})
+	commitBlock(t, tds, 2, func(s *StateDB) {
+		// Cleared slot must not be returned
+		s.SetState(addr, common.BigToHash(big.NewInt(5)), common.Hash{})
+	})
+	dbs := NewDbState(db, 2)
+	var all []StorageEntry
+	var start []byte
+	pages := 0
+	for {
+		slots, next, err := dbs.StorageRange(addr, start, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(slots) > 4 {
+			t.Fatalf("page %d has %d entries, more than requested", pages, len(slots))
+		}
+		all = append(all, slots...)
+		pages++
+		if next == nil {
+			break
+		}
+		if pages > 10 {
+			t.Fatal("too many pages")
+		}
+		start = next
+	}
+	if pages != 3 {
+		t.Errorf("expected 3 pages, got %d", pages)
+	}
+	if len(all) != 9 {
+		t.Fatalf("expected 9 entries, got %d", len(all))
+	}
+	for i, entry := range all {
+		if i > 0 && bytes.Compare(all[i-1].SecKey[:], entry.SecKey[:]) >= 0 {
+			t.Errorf("entries not ordered by secure key at %d", i)
+		}
+		if entry.SecKey != crypto.Keccak256Hash(entry.Key[:]) {
+			t.Errorf("wrong preimage %x for %x", entry.Key, entry.SecKey)
+		}
+		n := entry.Key.Big().Int64()
+		if n == 5 || entry.Value.Big().Int64() != 100+n {
+			t.Errorf("unexpected entry %x: %x", entry.Key, entry.Value)
+		}
+	}
+	// Page ending exactly at the last item has no continuation
+	if slots, next, err := dbs.StorageRange(addr, nil, 9); err != nil || len(slots) != 9 || next != nil {
+		t.Errorf("expected 9 entries without continuation, got %d, next %x, err %v", len(slots), next, err)
+	}
+	if _, _, err := dbs.StorageRange(addr, nil, 0); err == nil {
+		t.Errorf("expected an error for zero maxResults")
+	}
+	// Failed read is not mistaken for the end of the storage
+	if slots, next, err := NewDbState(failingWalkGetter{db}, 2).StorageRange(addr, nil, 4); err != errWalkFailed {
+		t.Errorf("expected the walk error, got %d entries, next %x, err %v", len(slots), next, err)
+	}
+}
+
+var errWalkFailed = errors.New("walk failed")
+
+// failingWalkGetter is a database whose historical walks fail
+type failingWalkGetter struct {
+	ethdb.Getter
+}
+
+func (failingWalkGetter) WalkAsOf(bucket, hBucket, startkey []byte, fixedbits uint, timestamp uint64, walker func([]byte, []byte) (bool, error)) error {
+	return errWalkFailed
+}
+
+func TestDeletedAccountStorage(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	addr := common.HexToAddress("0x1234")
+	oldSlot := common.HexToHash("0x01")
+	newSlot := common.HexToHash("0x02")
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		s.SetBalance(addr, big.NewInt(1))
+		s.SetState(addr, oldSlot, common.HexToHash("0x0a"))
+	})
+	commitBlock(t, tds, 2, func(s *StateDB) {
+		s.Suicide(addr)
+	})
+	commitBlock(t, tds, 3, func(s *StateDB) {
+		s.CreateAccount(addr, true)
+		s.SetBalance(addr, big.NewInt(2))
+		s.SetState(addr, newSlot, common.HexToHash("0x0b"))
+	})
+	for _, test := range []struct {
+		blockNr       uint64
+		slot          common.Hash
+		expectedValue []byte
+	}{
+		{1, oldSlot, []byte{0x0a}},
+		{2, oldSlot, nil},
+		{3, oldSlot, nil},
+		{3, newSlot, []byte{0x0b}},
+	} {
+		dbs := NewDbState(db, test.blockNr)
+		value, err := dbs.ReadAccountStorage(addr, &test.slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, test.expectedValue) {
+			t.Errorf("block %d, slot %x: got %x, expected %x", test.blockNr, test.slot, value, test.expectedValue)
+		}
+	}
+	var slots []common.Hash
+	NewDbState(db, 3).ForEachStorage(addr, nil, func(key, seckey, value common.Hash) bool {
+		slots = append(slots, key)
+		return true
+	}, 10)
+	if len(slots) != 1 || slots[0] != newSlot {
+		t.Errorf("expected only the slot of the new incarnation, got %x", slots)
+	}
+}
+
+func TestAddressHash(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		addr := common.BytesToAddress(crypto.Keccak256([]byte{byte(i)}))
+		if h := AddressHash(addr); h != crypto.Keccak256Hash(addr[:]) {
+			t.Errorf("wrong hash of %x: %x", addr, h)
+		}
+	}
+}
+
+func TestHasherParallel(t *testing.T) {
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				data := []byte{byte(g), byte(i), byte(i >> 8)}
+				h := newHasher()
+				h.sha.Reset()
+				h.sha.Write(data)
+				var buf common.Hash
+				h.sha.Read(buf[:])
+				returnHasherToPool(h)
+				if buf != crypto.Keccak256Hash(data) {
+					t.Errorf("wrong hash of %x: %x", data, buf)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestSetHasherPoolSizeConcurrent(t *testing.T) {
+	defer SetHasherPoolSize(128)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				addr := common.BytesToAddress([]byte{byte(g), byte(i), byte(i >> 8)})
+				if h := AddressHash(addr); h != crypto.Keccak256Hash(addr[:]) {
+					t.Errorf("wrong hash of %x: %x", addr, h)
+					return
+				}
+			}
+		}(g)
+	}
+	for size := 1; size <= 64; size *= 2 {
+		SetHasherPoolSize(size)
+	}
+	wg.Wait()
+}
+
+func BenchmarkHasherParallel(b *testing.B) {
+	var data [32]byte
+	b.RunParallel(func(pb *testing.PB) {
+		var buf common.Hash
+		for pb.Next() {
+			h := newHasher()
+			h.sha.Reset()
+			h.sha.Write(data[:])
+			h.sha.Read(buf[:])
+			returnHasherToPool(h)
+		}
+	})
+}
+
+func TestStorageRootHash(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	addr := common.HexToAddress("0x1234")
+	empty := common.HexToAddress("0x5678")
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		s.SetBalance(empty, big.NewInt(1))
+		s.SetBalance(addr, big.NewInt(1))
+		for i := 1; i <= 100; i++ {
+			s.SetState(addr, common.BigToHash(big.NewInt(int64(i))), common.BigToHash(big.NewInt(int64(1000+i))))
+		}
+	})
+	commitBlock(t, tds, 2, func(s *StateDB) {
+		s.SetState(addr, common.BigToHash(big.NewInt(7)), common.Hash{})
+		s.SetState(addr, common.BigToHash(big.NewInt(200)), common.BigToHash(big.NewInt(1)))
+	})
+	for blockNr := uint64(1); blockNr <= 2; blockNr++ {
+		account, err := NewDbState(db, blockNr).ReadAccountData(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := StorageRootHash(db, addr, blockNr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != account.Root {
+			t.Errorf("block %d: storage root %x, stored in the account %x", blockNr, root, account.Root)
+		}
+	}
+	if root, err := StorageRootHash(db, empty, 2); err != nil || root != emptyRoot {
+		t.Errorf("expected empty root for an account without storage, got %x, err %v", root, err)
+	}
+}
+
+func TestHistoricalTrieDbStateReads(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	addr := common.HexToAddress("0x1234")
+	slot := common.HexToHash("0x01")
+	var roots []common.Hash
+	for blockNr := uint64(1); blockNr <= 3; blockNr++ {
+		commitBlock(t, tds, blockNr, func(s *StateDB) {
+			s.SetBalance(addr, big.NewInt(int64(blockNr)))
+			s.SetState(addr, slot, common.BigToHash(big.NewInt(int64(10*blockNr))))
+		})
+		root, err := tds.TrieRoot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, root)
+	}
+	// Historical state at a block must read the values written by that block,
+	// the same as DbState and the trie resolver do
+	for blockNr := uint64(1); blockNr <= 2; blockNr++ {
+		historical, err := NewTrieDbState(roots[blockNr-1], db, blockNr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		historical.SetHistorical(true)
+		account, err := historical.ReadAccountData(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account == nil || account.Balance.Int64() != int64(blockNr) {
+			t.Errorf("block %d: wrong account %v", blockNr, account)
+		}
+		value, err := historical.ReadAccountStorage(addr, &slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if common.BytesToHash(value).Big().Int64() != int64(10*blockNr) {
+			t.Errorf("block %d: wrong storage value %x", blockNr, value)
+		}
+	}
+}
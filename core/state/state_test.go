@@ -24,6 +24,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
 	checker "gopkg.in/check.v1"
 )
 
@@ -249,3 +250,100 @@ func compareStateObjects(so0, so1 *stateObject, t *testing.T) {
 		}
 	}
 }
+
+func TestRebuildFlushing(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		for i := 0; i < 3000; i++ {
+			addr := common.BigToAddress(big.NewInt(int64(i + 1)))
+			s.SetBalance(addr, big.NewInt(int64(i+1)))
+			if i%10 == 0 {
+				s.SetState(addr, common.Hash{}, common.BigToHash(big.NewInt(int64(i+1))))
+			}
+		}
+	})
+	root, err := tds.TrieRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inMemory, _ := NewTrieDbState(root, db, 1)
+	inMemory.Rebuild()
+	// Hash left by an earlier rebuild, for a subtrie that does not exist
+	stale := []byte{0xf, 0xf, 0xf, 0xf, 0xf}
+	if err = db.Put(trie.IntermediateHashesBucket, stale, root[:]); err != nil {
+		t.Fatal(err)
+	}
+	flushing, _ := NewTrieDbState(root, db, 1)
+	if err = flushing.RebuildFlushing(100); err != nil {
+		t.Fatal(err)
+	}
+	if h := inMemory.AccountTrie().Hash(); h != root {
+		t.Errorf("in-memory rebuild: root %x, expected %x", h, root)
+	}
+	if h := flushing.AccountTrie().Hash(); h != root {
+		t.Errorf("flushing rebuild: root %x, expected %x", h, root)
+	}
+	// Only the spine of the trie stays resident, the subtries are replaced by their hashes
+	if nodes := flushing.AccountTrie().CountNodes(make(map[uint64]int)); nodes > 300 {
+		t.Errorf("too many nodes resident after the flushing rebuild: %d", nodes)
+	}
+	counted, _ := NewTrieDbState(root, db, 1)
+	batch := &peakCountingBatch{Mutation: db.NewBatch(), t: counted.AccountTrie()}
+	batch.SetFlushPolicy(100, 0)
+	if _, err = counted.AccountTrie().RebuildFlushing(db, batch, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if batch.checks == 0 {
+		t.Errorf("resident nodes were not counted during the flushing rebuild")
+	}
+	if batch.peak > 300 {
+		t.Errorf("too many nodes resident during the flushing rebuild: %d", batch.peak)
+	}
+	flushed := 0
+	if err = db.Walk(trie.IntermediateHashesBucket, nil, 0, func(k, v []byte) (bool, error) {
+		if bytes.Equal(k, stale) {
+			t.Errorf("stale intermediate hash was not cleared")
+		}
+		if len(v) != common.HashLength {
+			t.Errorf("wrong intermediate hash %x for %x", v, k)
+		}
+		flushed++
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if flushed == 0 {
+		t.Errorf("no intermediate hashes were flushed")
+	}
+	// Rebuilt trie is usable for reading the accounts
+	for _, i := range []int64{1, 1500, 3000} {
+		account, err := flushing.ReadAccountData(common.BigToAddress(big.NewInt(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account == nil || account.Balance.Int64() != i {
+			t.Errorf("wrong account %d: %v", i, account)
+		}
+	}
+}
+
+// peakCountingBatch records the largest number of nodes resident in the trie
+// at the points where the flushing rebuild offers to commit the batch
+type peakCountingBatch struct {
+	ethdb.Mutation
+	t      *trie.Trie
+	checks int
+	peak   int
+}
+
+func (b *peakCountingBatch) CommitIfNeeded() (bool, error) {
+	b.checks++
+	if nodes := b.t.CountNodes(make(map[uint64]int)); nodes > b.peak {
+		b.peak = nodes
+	}
+	return b.Mutation.CommitIfNeeded()
+}
@@ -0,0 +1,376 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// ForEachStorageGlobal streams the storage items of all contracts as of the block blockNr,
+// in the order of the keys in the StorageBucket, i.e. grouped by the account and then
+// ordered by the secure keys of the slots. Storage keys start with the plain account
+// address, so no preimages are needed to report the accounts.
+// The walk stops as soon as cb returns false.
+func ForEachStorageGlobal(db ethdb.Getter, blockNr uint64, cb func(account common.Address, slotSecKey, value common.Hash) bool) error {
+	var startkey [common.AddressLength + common.HashLength]byte
+	return db.WalkAsOf(StorageBucket, StorageHistoryBucket, startkey[:], 0, blockNr+1, func(k, v []byte) (bool, error) {
+		if len(v) == 0 {
+			// Skip deleted entries
+			return true, nil
+		}
+		var account common.Address
+		var seckey common.Hash
+		copy(account[:], k[:common.AddressLength])
+		copy(seckey[:], k[common.AddressLength:])
+		return cb(account, seckey, common.BytesToHash(v)), nil
+	})
+}
+
+// AccountStorageSize is the number of non-empty storage slots of an account
+type AccountStorageSize struct {
+	Address common.Address
+	Slots   int
+}
+
+// ranksBefore reports whether the account a comes before the account b in the
+// result of TopStorageAccounts
+func ranksBefore(a, b AccountStorageSize) bool {
+	if a.Slots != b.Slots {
+		return a.Slots > b.Slots
+	}
+	return bytes.Compare(a.Address[:], b.Address[:]) < 0
+}
+
+// storageSizeHeap keeps the accounts with the last ranked one on top, so that it
+// is the one replaced when a higher ranked account is found
+type storageSizeHeap []AccountStorageSize
+
+func (h storageSizeHeap) Len() int            { return len(h) }
+func (h storageSizeHeap) Less(i, j int) bool  { return ranksBefore(h[j], h[i]) }
+func (h storageSizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *storageSizeHeap) Push(x interface{}) { *h = append(*h, x.(AccountStorageSize)) }
+func (h *storageSizeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// TopStorageAccounts returns up to n accounts with the largest number of storage
+// slots as of the block blockNr, ordered by the number of slots (descending),
+// and then by the address. Only n accounts are kept in memory during the walk.
+func TopStorageAccounts(db ethdb.Getter, blockNr uint64, n int) ([]AccountStorageSize, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	top := make(storageSizeHeap, 0, n)
+	var current AccountStorageSize
+	add := func() {
+		if current.Slots == 0 {
+			return
+		}
+		if len(top) < n {
+			heap.Push(&top, current)
+		} else if ranksBefore(current, top[0]) {
+			top[0] = current
+			heap.Fix(&top, 0)
+		}
+	}
+	// Storage items come grouped by the account, so the counting only needs the current group
+	if err := ForEachStorageGlobal(db, blockNr, func(account common.Address, _, _ common.Hash) bool {
+		if account != current.Address || current.Slots == 0 {
+			add()
+			current = AccountStorageSize{Address: account}
+		}
+		current.Slots++
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	add()
+	sizes := []AccountStorageSize(top)
+	sort.Slice(sizes, func(i, j int) bool {
+		return ranksBefore(sizes[i], sizes[j])
+	})
+	return sizes, nil
+}
+
+// StorageRoots computes the storage roots of all the contracts with non-empty storage
+// as of the block blockNr, in one pass over the StorageBucket. Storage items come
+// grouped by the account and ordered by the secure keys, so each root is computed
+// with a streaming trie.RootHasher, without building the storage tries in memory.
+// Accounts without storage are not included in the result, their root is the empty root.
+func StorageRoots(db ethdb.Getter, blockNr uint64) (map[common.Address]common.Hash, error) {
+	roots := make(map[common.Address]common.Hash)
+	var rh *trie.RootHasher
+	var current common.Address
+	finish := func() error {
+		if rh == nil {
+			return nil
+		}
+		root, err := rh.Finalize()
+		roots[current] = root
+		return err
+	}
+	var err error
+	if walkErr := ForEachStorageGlobal(db, blockNr, func(account common.Address, slotSecKey, value common.Hash) bool {
+		if rh == nil || account != current {
+			if err = finish(); err != nil {
+				return false
+			}
+			rh = trie.NewRootHasher()
+			current = account
+		}
+		err = addStorageItem(rh, slotSecKey, value)
+		return err == nil
+	}); walkErr != nil {
+		return nil, walkErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// addStorageItem adds a storage item to the hasher of the storage trie
+func addStorageItem(rh *trie.RootHasher, slotSecKey, value common.Hash) error {
+	// Leaves of the storage tries contain the RLP encodings of the values
+	enc, err := rlp.EncodeToBytes(bytes.TrimLeft(value[:], "\x00"))
+	if err != nil {
+		return err
+	}
+	return rh.Add(slotSecKey[:], enc)
+}
+
+// storageSlots returns the secure keys of the non-empty storage slots of the account
+// as of the block blockNr
+func storageSlots(db ethdb.Getter, addr common.Address, blockNr uint64) (map[common.Hash]struct{}, error) {
+	slots := make(map[common.Hash]struct{})
+	var startkey [common.AddressLength + common.HashLength]byte
+	copy(startkey[:], addr[:])
+	if err := db.WalkAsOf(StorageBucket, StorageHistoryBucket, startkey[:], 8*common.AddressLength, blockNr+1, func(k, v []byte) (bool, error) {
+		if len(v) > 0 {
+			slots[common.BytesToHash(k[common.AddressLength:])] = struct{}{}
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return slots, nil
+}
+
+// StorageSizeDelta returns the number of storage slots of the account that became
+// non-empty (added) and that became empty (removed) between the state after the
+// block fromBlock and the state after the block toBlock. Slots that only changed
+// their value are not counted. The storage of an account deleted in between counts
+// as removed, and the storage of an account created in between counts as added.
+func StorageSizeDelta(db ethdb.Getter, addr common.Address, fromBlock, toBlock uint64) (added, removed int, err error) {
+	fromSlots, err := storageSlots(db, addr, fromBlock)
+	if err != nil {
+		return 0, 0, err
+	}
+	toSlots, err := storageSlots(db, addr, toBlock)
+	if err != nil {
+		return 0, 0, err
+	}
+	for slot := range toSlots {
+		if _, ok := fromSlots[slot]; !ok {
+			added++
+		}
+	}
+	for slot := range fromSlots {
+		if _, ok := toSlots[slot]; !ok {
+			removed++
+		}
+	}
+	return added, removed, nil
+}
+
+// VerifyCodePresence checks that the code of every account with non-empty code as
+// of the block blockNr is present in the CodeBucket, and returns the code hashes
+// that are missing from it. Code shared by many accounts is only checked once.
+func VerifyCodePresence(db ethdb.Getter, blockNr uint64) (missing []common.Hash, err error) {
+	checked := make(map[common.Hash]struct{})
+	var startkey [common.HashLength]byte
+	err = db.WalkAsOf(AccountsBucket, AccountsHistoryBucket, startkey[:], 0, blockNr+1, func(k, v []byte) (bool, error) {
+		account, err := encodingToAccount(v)
+		if err != nil {
+			return false, fmt.Errorf("decoding account %x: %v", k, err)
+		}
+		if account == nil {
+			// Skip deleted entries
+			return true, nil
+		}
+		codeHash := common.BytesToHash(account.CodeHash)
+		if codeHash == emptyCodeHashH {
+			return true, nil
+		}
+		if _, ok := checked[codeHash]; ok {
+			return true, nil
+		}
+		checked[codeHash] = struct{}{}
+		has, err := db.Has(CodeBucket, codeHash[:])
+		if err != nil {
+			return false, err
+		}
+		if !has {
+			missing = append(missing, codeHash)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
+
+// StorageRootMismatch describes a contract whose storage root, reconstructed from
+// the storage items, differs from the root stored in the account
+type StorageRootMismatch struct {
+	Address  common.Address // Zero for accounts without storage items, only their hashes are known
+	AddrHash common.Hash
+	Stored   common.Hash // Storage root recorded in the account, empty root if there is no account
+	Computed common.Hash // Storage root reconstructed from the StorageBucket
+}
+
+// VerifyAllStorageRoots reconstructs the storage roots of all the contracts as of
+// the block blockNr and compares them with the storage roots stored in the accounts.
+// The storage items are read in one pass over the StorageBucket, as in StorageRoots,
+// and the storage of each contract is hashed by one of the given number of worker
+// goroutines. The accounts are then read in one pass over the AccountsBucket, so
+// that accounts with a storage root but without storage items are reported as well.
+// The mismatches are returned ordered by the address hash.
+func VerifyAllStorageRoots(db ethdb.Getter, blockNr uint64, workers int) ([]StorageRootMismatch, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	type storage struct {
+		address common.Address
+		seckeys []common.Hash
+		values  []common.Hash
+	}
+	type computed struct {
+		address common.Address
+		root    common.Hash
+	}
+	jobs := make(chan *storage, workers)
+	var (
+		mu       sync.Mutex
+		roots    = make(map[common.Hash]computed) // Computed storage roots, by the address hash
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for st := range jobs {
+				rh := trie.NewRootHasher()
+				var err error
+				for j := 0; j < len(st.seckeys) && err == nil; j++ {
+					err = addStorageItem(rh, st.seckeys[j], st.values[j])
+				}
+				var root common.Hash
+				if err == nil {
+					root, err = rh.Finalize()
+				}
+				addrHash := AddressHash(st.address)
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("computing storage root of %x: %v", st.address, err)
+					}
+				} else {
+					roots[addrHash] = computed{st.address, root}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	// Storage items come grouped by the account, each group is handed over once complete
+	var current *storage
+	walkErr := ForEachStorageGlobal(db, blockNr, func(account common.Address, slotSecKey, value common.Hash) bool {
+		if current == nil || current.address != account {
+			if current != nil {
+				jobs <- current
+			}
+			current = &storage{address: account}
+		}
+		current.seckeys = append(current.seckeys, slotSecKey)
+		current.values = append(current.values, value)
+		return true
+	})
+	if current != nil && walkErr == nil {
+		jobs <- current
+	}
+	close(jobs)
+	wg.Wait()
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var mismatches []StorageRootMismatch
+	var startkey [common.HashLength]byte
+	if err := db.WalkAsOf(AccountsBucket, AccountsHistoryBucket, startkey[:], 0, blockNr+1, func(k, v []byte) (bool, error) {
+		account, err := encodingToAccount(v)
+		if err != nil {
+			return false, fmt.Errorf("decoding account %x: %v", k, err)
+		}
+		if account == nil {
+			// Skip deleted entries
+			return true, nil
+		}
+		addrHash := common.BytesToHash(k)
+		c, ok := roots[addrHash]
+		if !ok {
+			if account.Root != emptyRoot {
+				mismatches = append(mismatches, StorageRootMismatch{AddrHash: addrHash, Stored: account.Root, Computed: emptyRoot})
+			}
+			return true, nil
+		}
+		delete(roots, addrHash)
+		if c.root != account.Root {
+			mismatches = append(mismatches, StorageRootMismatch{Address: c.address, AddrHash: addrHash, Stored: account.Root, Computed: c.root})
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	// Storage items left over belong to accounts that do not exist
+	for addrHash, c := range roots {
+		mismatches = append(mismatches, StorageRootMismatch{Address: c.address, AddrHash: addrHash, Stored: emptyRoot, Computed: c.root})
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return bytes.Compare(mismatches[i].AddrHash[:], mismatches[j].AddrHash[:]) < 0
+	})
+	return mismatches, nil
+}
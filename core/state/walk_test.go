@@ -0,0 +1,380 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+type globalStorageItem struct {
+	account common.Address
+	seckey  common.Hash
+	value   common.Hash
+}
+
+func collectStorageGlobal(t *testing.T, db ethdb.Getter, blockNr uint64) []globalStorageItem {
+	var items []globalStorageItem
+	if err := ForEachStorageGlobal(db, blockNr, func(account common.Address, seckey, value common.Hash) bool {
+		items = append(items, globalStorageItem{account, seckey, value})
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func TestForEachStorageGlobal(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	addr1 := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	addr2 := common.HexToAddress("0x2000000000000000000000000000000000000002")
+	slot := func(i byte) common.Hash { return common.BytesToHash([]byte{i}) }
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		s.SetBalance(addr1, big.NewInt(1))
+		s.SetBalance(addr2, big.NewInt(1))
+		for i := byte(1); i <= 3; i++ {
+			s.SetState(addr1, slot(i), slot(0x10+i))
+		}
+		for i := byte(1); i <= 2; i++ {
+			s.SetState(addr2, slot(i), slot(0x20+i))
+		}
+	})
+	commitBlock(t, tds, 2, func(s *StateDB) {
+		s.SetState(addr1, slot(1), common.Hash{})
+		s.SetState(addr2, slot(3), slot(0x23))
+	})
+	expected := map[uint64]map[common.Address]map[common.Hash]common.Hash{
+		1: {
+			addr1: {slot(1): slot(0x11), slot(2): slot(0x12), slot(3): slot(0x13)},
+			addr2: {slot(1): slot(0x21), slot(2): slot(0x22)},
+		},
+		2: {
+			addr1: {slot(2): slot(0x12), slot(3): slot(0x13)},
+			addr2: {slot(1): slot(0x21), slot(2): slot(0x22), slot(3): slot(0x23)},
+		},
+	}
+	for blockNr, accounts := range expected {
+		items := collectStorageGlobal(t, db, blockNr)
+		count := 0
+		for _, slots := range accounts {
+			count += len(slots)
+		}
+		if len(items) != count {
+			t.Fatalf("block %d: expected %d items, got %d", blockNr, count, len(items))
+		}
+		for i, item := range items {
+			if i > 0 {
+				prev := items[i-1]
+				if c := bytes.Compare(prev.account[:], item.account[:]); c > 0 || c == 0 && bytes.Compare(prev.seckey[:], item.seckey[:]) >= 0 {
+					t.Errorf("block %d: items are out of order at %d", blockNr, i)
+				}
+			}
+			found := false
+			for key, value := range accounts[item.account] {
+				if crypto.Keccak256Hash(key[:]) == item.seckey {
+					found = true
+					if value != item.value {
+						t.Errorf("block %d: wrong value for %x %x: got %x, want %x", blockNr, item.account, key, item.value, value)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("block %d: unexpected item %x %x", blockNr, item.account, item.seckey)
+			}
+		}
+	}
+	// Check that the walk stops when the callback returns false
+	visited := 0
+	if err := ForEachStorageGlobal(db, 2, func(common.Address, common.Hash, common.Hash) bool {
+		visited++
+		return visited < 2
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if visited != 2 {
+		t.Errorf("expected walk to stop after 2 items, visited %d", visited)
+	}
+}
+
+func TestTopStorageAccounts(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	// Number of slots of each contract at block 1
+	slotCounts := []int{3, 7, 1, 5, 3}
+	addrs := make([]common.Address, len(slotCounts))
+	for i := range addrs {
+		addrs[i] = common.BytesToAddress([]byte{byte(i + 1)})
+	}
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		for i, addr := range addrs {
+			s.SetBalance(addr, big.NewInt(1))
+			for j := 0; j < slotCounts[i]; j++ {
+				s.SetState(addr, common.BigToHash(big.NewInt(int64(j))), common.BigToHash(big.NewInt(int64(j+1))))
+			}
+		}
+	})
+	commitBlock(t, tds, 2, func(s *StateDB) {
+		// Clear all but one slot of the largest contract
+		for j := 1; j < 7; j++ {
+			s.SetState(addrs[1], common.BigToHash(big.NewInt(int64(j))), common.Hash{})
+		}
+	})
+	top, err := TopStorageAccounts(db, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []AccountStorageSize{{addrs[1], 7}, {addrs[3], 5}, {addrs[0], 3}}
+	if !reflect.DeepEqual(top, expected) {
+		t.Errorf("block 1: got %v, expected %v", top, expected)
+	}
+	top, err = TopStorageAccounts(db, 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []AccountStorageSize{{addrs[3], 5}, {addrs[0], 3}, {addrs[4], 3}, {addrs[1], 1}, {addrs[2], 1}}
+	if !reflect.DeepEqual(top, expected) {
+		t.Errorf("block 2: got %v, expected %v", top, expected)
+	}
+	// Accounts with the same number of slots are cut off by the address
+	top, err = TopStorageAccounts(db, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []AccountStorageSize{{addrs[3], 5}, {addrs[0], 3}}
+	if !reflect.DeepEqual(top, expected) {
+		t.Errorf("block 2, top 2: got %v, expected %v", top, expected)
+	}
+	if top, err = TopStorageAccounts(db, 2, 0); err != nil || len(top) != 0 {
+		t.Errorf("expected no accounts for n = 0, got %v, err %v", top, err)
+	}
+}
+
+func TestStorageRoots(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	contract1 := common.HexToAddress("0x1234")
+	contract2 := common.HexToAddress("0x5678")
+	eoa := common.HexToAddress("0x9abc")
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		s.SetBalance(eoa, big.NewInt(1))
+		s.SetBalance(contract1, big.NewInt(1))
+		s.SetBalance(contract2, big.NewInt(1))
+		for i := 1; i <= 50; i++ {
+			s.SetState(contract1, common.BigToHash(big.NewInt(int64(i))), common.BigToHash(big.NewInt(int64(1000*i))))
+		}
+		s.SetState(contract2, common.Hash{}, common.HexToHash("0x01"))
+	})
+	commitBlock(t, tds, 2, func(s *StateDB) {
+		s.SetState(contract1, common.BigToHash(big.NewInt(3)), common.Hash{})
+		s.SetState(contract2, common.HexToHash("0x02"), common.HexToHash("0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"))
+	})
+	for blockNr := uint64(1); blockNr <= 2; blockNr++ {
+		roots, err := StorageRoots(db, blockNr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roots) != 2 {
+			t.Errorf("block %d: expected 2 storage roots, got %d", blockNr, len(roots))
+		}
+		dbs := NewDbState(db, blockNr)
+		for _, addr := range []common.Address{contract1, contract2} {
+			account, err := dbs.ReadAccountData(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if roots[addr] != account.Root {
+				t.Errorf("block %d, account %x: computed root %x, stored %x", blockNr, addr, roots[addr], account.Root)
+			}
+		}
+	}
+}
+
+func TestStorageSizeDelta(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	addr := common.HexToAddress("0x1234")
+	other := common.HexToAddress("0x1235")
+	slot := func(i int64) common.Hash { return common.BigToHash(big.NewInt(i)) }
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		s.SetBalance(other, big.NewInt(1))
+		s.SetState(other, slot(1), slot(1))
+	})
+	commitBlock(t, tds, 2, func(s *StateDB) {
+		// Account created with 3 slots
+		s.SetBalance(addr, big.NewInt(1))
+		for i := int64(1); i <= 3; i++ {
+			s.SetState(addr, slot(i), slot(i))
+		}
+	})
+	commitBlock(t, tds, 3, func(s *StateDB) {
+		// 2 slots added, 1 cleared, 1 changed
+		s.SetState(addr, slot(4), slot(4))
+		s.SetState(addr, slot(5), slot(5))
+		s.SetState(addr, slot(1), common.Hash{})
+		s.SetState(addr, slot(2), slot(20))
+	})
+	commitBlock(t, tds, 4, func(s *StateDB) {
+		s.Suicide(addr)
+	})
+	commitBlock(t, tds, 5, func(s *StateDB) {
+		s.CreateAccount(addr, true)
+		s.SetBalance(addr, big.NewInt(1))
+		s.SetState(addr, slot(6), slot(6))
+	})
+	for _, test := range []struct {
+		fromBlock, toBlock uint64
+		added, removed     int
+	}{
+		{1, 2, 3, 0},
+		{2, 3, 2, 1},
+		{1, 3, 4, 0},
+		{3, 4, 0, 4},
+		{2, 5, 1, 3},
+		{3, 3, 0, 0},
+		{4, 5, 1, 0},
+	} {
+		added, removed, err := StorageSizeDelta(db, addr, test.fromBlock, test.toBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != test.added || removed != test.removed {
+			t.Errorf("blocks %d-%d: got +%d -%d, expected +%d -%d", test.fromBlock, test.toBlock, added, removed, test.added, test.removed)
+		}
+	}
+}
+
+func TestVerifyCodePresence(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	shared, other := []byte{0x60, 0x01}, []byte{0x60, 0x02}
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		s.SetBalance(common.HexToAddress("0x01"), big.NewInt(1))
+		s.SetCode(common.HexToAddress("0x02"), shared)
+		s.SetCode(common.HexToAddress("0x03"), shared)
+		s.SetCode(common.HexToAddress("0x04"), other)
+	})
+	missing, err := VerifyCodePresence(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("unexpected missing code %x", missing)
+	}
+	sharedHash := crypto.Keccak256Hash(shared)
+	if err = db.Delete(CodeBucket, sharedHash[:]); err != nil {
+		t.Fatal(err)
+	}
+	missing, err = VerifyCodePresence(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0] != sharedHash {
+		t.Errorf("expected only %x missing, got %x", sharedHash, missing)
+	}
+}
+
+func TestVerifyAllStorageRoots(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	var contracts []common.Address
+	for i := 1; i <= 10; i++ {
+		contracts = append(contracts, common.BigToAddress(big.NewInt(int64(0x100*i))))
+	}
+	commitBlock(t, tds, 1, func(s *StateDB) {
+		// Account without storage is not a contract to verify
+		s.SetBalance(common.HexToAddress("0x01"), big.NewInt(1))
+		for i, addr := range contracts {
+			s.SetBalance(addr, big.NewInt(1))
+			for j := 1; j <= 5*(i+1); j++ {
+				s.SetState(addr, common.BigToHash(big.NewInt(int64(j))), common.BigToHash(big.NewInt(int64(1000+j))))
+			}
+		}
+	})
+	mismatches, err := VerifyAllStorageRoots(db, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("unexpected mismatches %v", mismatches)
+	}
+	// Tamper with one storage item of one contract
+	tampered := contracts[6]
+	seckey := crypto.Keccak256Hash(common.BigToHash(big.NewInt(3)).Bytes())
+	if err = db.Put(StorageBucket, append(common.CopyBytes(tampered[:]), seckey[:]...), []byte{0x42}); err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{1, 3, 16} {
+		mismatches, err = VerifyAllStorageRoots(db, 1, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mismatches) != 1 || mismatches[0].Address != tampered {
+			t.Fatalf("%d workers: expected only %x reported, got %v", workers, tampered, mismatches)
+		}
+		account, err := NewDbState(db, 1).ReadAccountData(tampered)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mismatches[0].Stored != account.Root || mismatches[0].Computed == account.Root {
+			t.Errorf("%d workers: wrong mismatch %v", workers, mismatches[0])
+		}
+	}
+	// Remove all the storage items of another contract, and add storage to an account that does not exist
+	emptied := contracts[0]
+	for j := 1; j <= 5; j++ {
+		seckey := crypto.Keccak256Hash(common.BigToHash(big.NewInt(int64(j))).Bytes())
+		if err = db.Delete(StorageBucket, append(common.CopyBytes(emptied[:]), seckey[:]...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	missing := common.HexToAddress("0xdead")
+	if err = db.Put(StorageBucket, append(common.CopyBytes(missing[:]), seckey[:]...), []byte{0x42}); err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err = VerifyAllStorageRoots(db, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 3 {
+		t.Fatalf("expected 3 mismatches, got %v", mismatches)
+	}
+	for i, m := range mismatches {
+		if i > 0 && bytes.Compare(mismatches[i-1].AddrHash[:], m.AddrHash[:]) >= 0 {
+			t.Errorf("mismatches are out of order at %d", i)
+		}
+		switch m.AddrHash {
+		case AddressHash(tampered):
+		case AddressHash(emptied):
+			if m.Address != (common.Address{}) || m.Computed != emptyRoot || m.Stored == emptyRoot {
+				t.Errorf("wrong mismatch for the contract without storage items %v", m)
+			}
+		case AddressHash(missing):
+			if m.Address != missing || m.Stored != emptyRoot {
+				t.Errorf("wrong mismatch for the storage without account %v", m)
+			}
+		default:
+			t.Errorf("unexpected mismatch %v", m)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethdb
+
+// historyPrefix is prepended to the name of a bucket to form the name of the
+// bucket keeping the history of its changes, for example "AT" -> "hAT"
+const historyPrefix = 'h'
+
+func isHistoryBucket(bucket []byte) bool {
+	return len(bucket) > 1 && bucket[0] == historyPrefix
+}
+
+// HistoryBucket returns the name of the history bucket for the given bucket.
+// It returns nil if the bucket name is empty or is itself the name of a history bucket,
+// so that the history prefix never gets applied twice.
+func HistoryBucket(bucket []byte) []byte {
+	if len(bucket) == 0 || isHistoryBucket(bucket) {
+		return nil
+	}
+	hBucket := make([]byte, len(bucket)+1)
+	hBucket[0] = historyPrefix
+	copy(hBucket[1:], bucket)
+	return hBucket
+}
+
+// BucketFromHistory is the inverse of HistoryBucket, it returns the name of the bucket
+// which history is kept in hBucket, or nil if hBucket is not a history bucket.
+// The returned slice shares the memory with hBucket.
+func BucketFromHistory(hBucket []byte) []byte {
+	if !isHistoryBucket(hBucket) {
+		return nil
+	}
+	return hBucket[1:]
+}
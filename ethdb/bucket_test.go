@@ -0,0 +1,83 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethdb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHistoryBucket(t *testing.T) {
+	pairs := []struct {
+		bucket, hBucket string
+	}{
+		{"AT", "hAT"}, // Accounts
+		{"ST", "hST"}, // Storage
+	}
+	for _, p := range pairs {
+		if hBucket := HistoryBucket([]byte(p.bucket)); !bytes.Equal(hBucket, []byte(p.hBucket)) {
+			t.Errorf("HistoryBucket(%q) = %q, want %q", p.bucket, hBucket, p.hBucket)
+		}
+		if bucket := BucketFromHistory([]byte(p.hBucket)); !bytes.Equal(bucket, []byte(p.bucket)) {
+			t.Errorf("BucketFromHistory(%q) = %q, want %q", p.hBucket, bucket, p.bucket)
+		}
+	}
+	for _, bucket := range []string{"", "hAT", "hST"} {
+		if hBucket := HistoryBucket([]byte(bucket)); hBucket != nil {
+			t.Errorf("HistoryBucket(%q) = %q, want nil", bucket, hBucket)
+		}
+	}
+	for _, hBucket := range []string{"", "h", "AT", "ST"} {
+		if bucket := BucketFromHistory([]byte(hBucket)); bucket != nil {
+			t.Errorf("BucketFromHistory(%q) = %q, want nil", hBucket, bucket)
+		}
+	}
+}
+
+func TestRewindDataWrongBucket(t *testing.T) {
+	db := NewMemDatabase()
+	// "h" is not a history bucket, it must not be rewound into the unnamed bucket
+	if err := db.PutS([]byte("h"), []byte("key"), []byte("value"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RewindData(1, 0, func(bucket, key, value []byte) error { return nil }); err == nil {
+		t.Errorf("expected an error rewinding a change set in a non-history bucket")
+	}
+}
+
+func TestRewindDataHistoryBucket(t *testing.T) {
+	db := NewMemDatabase()
+	if err := db.Put([]byte("AT"), []byte("key"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutS([]byte("hAT"), []byte("key"), []byte("old"), 1); err != nil {
+		t.Fatal(err)
+	}
+	var rewound int
+	if err := db.RewindData(1, 0, func(bucket, key, value []byte) error {
+		rewound++
+		if !bytes.Equal(bucket, []byte("hAT")) || !bytes.Equal(key, []byte("key")) || !bytes.Equal(value, []byte("old")) {
+			t.Errorf("unexpected rewind data: bucket %q, key %q, value %q", bucket, key, value)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if rewound != 1 {
+		t.Errorf("expected 1 rewound key, got %d", rewound)
+	}
+}
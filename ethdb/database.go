@@ -26,6 +26,7 @@ import (
 	"os"
 	"path"
 	"sync"
+	"time"
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/log"
@@ -96,18 +97,12 @@ func compositeKeySuffix(key []byte, timestamp uint64) (composite, suffix []byte)
 	return composite, suffix
 }
 
-func historyBucket(bucket []byte) []byte {
-	hb := make([]byte, len(bucket)+1)
-	hb[0] = byte('h')
-	copy(hb[1:], bucket)
-	return hb
-}
-
 // Put puts the given key / value to the queue
 func (db *BoltDatabase) PutS(hBucket, key, value []byte, timestamp uint64) error {
 	composite, suffix := compositeKeySuffix(key, timestamp)
 	suffixkey := make([]byte, len(suffix)+len(hBucket))
 	copy(suffixkey, suffix)
+	copy(suffixkey[len(suffix):], hBucket)
 	err := db.db.Update(func(tx *bolt.Tx) error {
 		hb, err := tx.CreateBucketIfNotExists(hBucket, true)
 		if err != nil {
@@ -703,6 +698,10 @@ type mutation struct {
 	suffixkeys map[uint64]map[string][][]byte
 	mu         sync.RWMutex
 	db         Database
+
+	flushSize     int           // Number of items after which CommitIfNeeded commits, 0 to disable
+	flushInterval time.Duration // Time after which CommitIfNeeded commits, 0 to disable
+	lastCommit    time.Time
 }
 
 func (db *BoltDatabase) NewBatch() Mutation {
@@ -710,10 +709,31 @@ func (db *BoltDatabase) NewBatch() Mutation {
 		db:         db,
 		puts:       make(map[string]*llrb.LLRB),
 		suffixkeys: make(map[uint64]map[string][][]byte),
+		lastCommit: time.Now(),
 	}
 	return m
 }
 
+func (m *mutation) SetFlushPolicy(size int, interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushSize = size
+	m.flushInterval = interval
+}
+
+func (m *mutation) CommitIfNeeded() (bool, error) {
+	m.mu.RLock()
+	size, interval, lastCommit := m.flushSize, m.flushInterval, m.lastCommit
+	m.mu.RUnlock()
+	if (size == 0 || m.BatchSize() < size) && (interval == 0 || time.Since(lastCommit) < interval) {
+		return false, nil
+	}
+	if _, err := m.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (m *mutation) getMem(bucket, key []byte) ([]byte, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -1109,6 +1129,7 @@ func (m *mutation) Commit() (uint64, error) {
 		return 0, putErr
 	}
 	m.puts = make(map[string]*llrb.LLRB)
+	m.lastCommit = time.Now()
 	return written, nil
 }
 
@@ -1150,6 +1171,7 @@ func (m *mutation) NewBatch() Mutation {
 		db:         m,
 		puts:       make(map[string]*llrb.LLRB),
 		suffixkeys: make(map[uint64]map[string][][]byte),
+		lastCommit: time.Now(),
 	}
 	return mm
 }
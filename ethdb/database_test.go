@@ -27,6 +27,7 @@ import (
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func newTestDB() (*BoltDatabase, func()) {
@@ -157,6 +158,41 @@ func TestMemoryDB_ParallelPutGet(t *testing.T) {
 	testParallelPutGet(NewMemDatabase(), t)
 }
 
+func TestDB_PutSDeleteTimestamp(t *testing.T) {
+	db, remove := newTestDB()
+	defer remove()
+	testPutSDeleteTimestamp(db, t)
+}
+
+func TestMemoryDB_PutSDeleteTimestamp(t *testing.T) {
+	testPutSDeleteTimestamp(NewMemDatabase(), t)
+}
+
+func testPutSDeleteTimestamp(db Database, t *testing.T) {
+	hBucket := []byte("hTestBucket")
+	for _, key := range test_values {
+		if err := db.PutS(hBucket, []byte(key), []byte("v"+key), 5); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	// Change set of the timestamp is keyed by the timestamp and the history bucket
+	suffixkey := append(encodeTimestamp(5), hBucket...)
+	if has, err := db.Has(SuffixBucket, suffixkey); err != nil || !has {
+		t.Fatalf("change set %x not found, err %v", suffixkey, err)
+	}
+	if err := db.DeleteTimestamp(5); err != nil {
+		t.Fatalf("delete timestamp failed: %v", err)
+	}
+	for _, key := range test_values {
+		if data, _ := db.GetS(hBucket, []byte(key), 5); data != nil {
+			t.Errorf("history of %q not deleted: %q", key, data)
+		}
+	}
+	if has, _ := db.Has(SuffixBucket, suffixkey); has {
+		t.Errorf("change set %x not deleted", suffixkey)
+	}
+}
+
 func testParallelPutGet(db Database, t *testing.T) {
 	const n = 8
 	var pending sync.WaitGroup
@@ -212,3 +248,39 @@ func testParallelPutGet(db Database, t *testing.T) {
 	}
 	pending.Wait()
 }
+
+func TestBatchFlushPolicy(t *testing.T) {
+	db := NewMemDatabase()
+	batch := db.NewBatch()
+	batch.SetFlushPolicy(1000, 50*time.Millisecond)
+	if err := batch.Put(bucket, []byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if committed, err := batch.CommitIfNeeded(); err != nil || committed {
+		t.Fatalf("unexpected commit before the size or the interval are reached: %t, %v", committed, err)
+	}
+	if _, err := db.Get(bucket, []byte("key")); err == nil {
+		t.Fatalf("expected the key to be kept in the batch")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if committed, err := batch.CommitIfNeeded(); err != nil || !committed {
+		t.Fatalf("expected a commit after the interval: %t, %v", committed, err)
+	}
+	if v, err := db.Get(bucket, []byte("key")); err != nil || !bytes.Equal(v, []byte("value")) {
+		t.Fatalf("expected the key to be committed, got %q, %v", v, err)
+	}
+	// The interval starts again from the last commit
+	if committed, err := batch.CommitIfNeeded(); err != nil || committed {
+		t.Fatalf("unexpected commit right after the previous one: %t, %v", committed, err)
+	}
+	// Size threshold without the interval
+	batch.SetFlushPolicy(2, 0)
+	batch.Put(bucket, []byte("key1"), []byte("value1"))
+	if committed, _ := batch.CommitIfNeeded(); committed {
+		t.Fatalf("unexpected commit below the size threshold")
+	}
+	batch.Put(bucket, []byte("key2"), []byte("value2"))
+	if committed, err := batch.CommitIfNeeded(); err != nil || !committed {
+		t.Fatalf("expected a commit at the size threshold: %t, %v", committed, err)
+	}
+}
@@ -96,7 +96,10 @@ func encodeTimestamp(timestamp uint64) []byte {
 	return suffix
 }
 
-func decodeTimestamp(suffix []byte) (uint64, []byte) {
+// DecodeTimestamp decodes the timestamp (block number) encoded at the start of
+// the suffix, as in the keys of the history buckets and the change sets, and
+// returns it together with the rest of the suffix
+func DecodeTimestamp(suffix []byte) (uint64, []byte) {
 	bytecount := int(suffix[0] >> 5)
 	timestamp := uint64(suffix[0] & 0x1f)
 	for i := 1; i < bytecount; i++ {
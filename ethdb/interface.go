@@ -16,6 +16,8 @@
 
 package ethdb
 
+import "time"
+
 // Code using batches should try to add this much data to the batch.
 // The value was determined empirically.
 const IdealBatchSize = 100 * 1024
@@ -68,4 +70,12 @@ type Mutation interface {
 	Commit() (uint64, error)
 	Rollback()
 	BatchSize() int
+	// SetFlushPolicy makes CommitIfNeeded commit the batch once it holds at least
+	// size items, or once interval has elapsed since the previous commit,
+	// whichever happens first. Zero size or interval disables the respective check.
+	SetFlushPolicy(size int, interval time.Duration)
+	// CommitIfNeeded commits the batch if the flush policy says so, and reports
+	// whether it did. Long running jobs call it at points where the data in the
+	// batch is consistent, so that they checkpoint their progress periodically.
+	CommitIfNeeded() (bool, error)
 }
@@ -36,7 +36,7 @@ func rewindData(db Getter, timestampSrc, timestampDst uint64, df func(bucket, ke
 	m := make(map[string]map[string]struct{})
 	suffixDst := encodeTimestamp(timestampDst + 1)
 	if err := db.Walk(SuffixBucket, suffixDst, 0, func(k, v []byte) (bool, error) {
-		timestamp, bucket := decodeTimestamp(k)
+		timestamp, bucket := DecodeTimestamp(k)
 		if timestamp > timestampSrc {
 			return false, nil
 		}
@@ -83,14 +83,18 @@ func rewindData(db Getter, timestampSrc, timestampDst uint64, df func(bucket, ke
 	//sort.Sort(buckets)
 	for bucketStr, t := range m {
 		//t := m[bucketStr]
-		bucket := []byte(bucketStr)
+		hBucket := []byte(bucketStr)
+		bucket := BucketFromHistory(hBucket)
+		if bucket == nil {
+			return fmt.Errorf("change set refers to %q, which is not a history bucket", hBucket)
+		}
 		for keyStr := range t {
 			key := []byte(keyStr)
-			value, err := db.GetAsOf(bucket[1:], bucket, key, timestampDst+1)
+			value, err := db.GetAsOf(bucket, hBucket, key, timestampDst+1)
 			if err != nil {
 				value = nil
 			}
-			if err := df(bucket, key, value); err != nil {
+			if err := df(hBucket, key, value); err != nil {
 				return err
 			}
 		}
@@ -101,9 +105,10 @@ func rewindData(db Getter, timestampSrc, timestampDst uint64, df func(bucket, ke
 func GetModifiedAccounts(db Getter, starttimestamp, endtimestamp uint64) ([]common.Address, error) {
 	t := llrb.New()
 	startCode := encodeTimestamp(starttimestamp)
+	accountsHistoryBucket := HistoryBucket([]byte("AT"))
 	if err := db.Walk(SuffixBucket, startCode, 0, func(k, v []byte) (bool, error) {
-		timestamp, bucket := decodeTimestamp(k)
-		if !bytes.Equal(bucket, []byte("hAT")) {
+		timestamp, bucket := DecodeTimestamp(k)
+		if !bytes.Equal(bucket, accountsHistoryBucket) {
 			return true, nil
 		}
 		if timestamp > endtimestamp {
@@ -146,3 +151,88 @@ func GetModifiedAccounts(db Getter, starttimestamp, endtimestamp uint64) ([]comm
 	}
 	return accounts, nil
 }
+
+// ChangedKeysInBlock returns the keys of the given bucket (for example, "AT") that
+// were changed by the block blockNr, as recorded in the change set of that block
+// in the SuffixBucket. The keys are returned in the order they were recorded.
+func ChangedKeysInBlock(db Getter, bucket []byte, blockNr uint64) ([][]byte, error) {
+	hBucket := HistoryBucket(bucket)
+	if hBucket == nil {
+		return nil, fmt.Errorf("%q does not have a history bucket", bucket)
+	}
+	suffixkey := append(encodeTimestamp(blockNr), hBucket...)
+	v, err := db.Get(SuffixBucket, suffixkey)
+	if err == ErrKeyNotFound || v == nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keycount := int(binary.BigEndian.Uint32(v))
+	keys := make([][]byte, keycount)
+	for i, ki := 4, 0; ki < keycount; ki++ {
+		l := int(v[i])
+		i++
+		keys[ki] = common.CopyBytes(v[i : i+l])
+		i += l
+	}
+	return keys, nil
+}
+
+// ModifiedAccountsDiff splits the accounts modified within the block range rangeA
+// and the block range rangeB (both inclusive, as in GetModifiedAccounts) into the
+// accounts modified only in rangeA, only in rangeB, and in both ranges.
+func ModifiedAccountsDiff(db Getter, rangeA, rangeB [2]uint64) (onlyA, onlyB, both []common.Address, err error) {
+	accountsA, err := GetModifiedAccounts(db, rangeA[0], rangeA[1])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	accountsB, err := GetModifiedAccounts(db, rangeB[0], rangeB[1])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	inB := make(map[common.Address]struct{}, len(accountsB))
+	for _, address := range accountsB {
+		inB[address] = struct{}{}
+	}
+	inA := make(map[common.Address]struct{}, len(accountsA))
+	for _, address := range accountsA {
+		inA[address] = struct{}{}
+		if _, ok := inB[address]; ok {
+			both = append(both, address)
+		} else {
+			onlyA = append(onlyA, address)
+		}
+	}
+	for _, address := range accountsB {
+		if _, ok := inA[address]; !ok {
+			onlyB = append(onlyB, address)
+		}
+	}
+	return onlyA, onlyB, both, nil
+}
+
+// VerifyAsOfAtHead checks that, for each of the sample keys, the value read as of
+// the block following headBlock (i.e. the state after headBlock) is equal to the
+// value in the live bucket. A disagreement means that the history bucket contains
+// entries that are not consistent with the live data, for example entries left over
+// by an unwind. The keys that disagree are returned as hashes, so keys longer than
+// a hash are reported by their last common.HashLength bytes.
+func VerifyAsOfAtHead(db Getter, bucket, hBucket []byte, headBlock uint64, sampleKeys [][]byte) ([]common.Hash, error) {
+	var mismatched []common.Hash
+	for _, key := range sampleKeys {
+		live, err := db.Get(bucket, key)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		asOf, err := db.GetAsOf(bucket, hBucket, key, headBlock+1)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		// Missing keys and empty values both mean that there is no value
+		if !bytes.Equal(live, asOf) && (len(live) > 0 || len(asOf) > 0) {
+			mismatched = append(mismatched, common.BytesToHash(key))
+		}
+	}
+	return mismatched, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethdb
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+func sortedAddresses(addrs []common.Address) []common.Address {
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Hex() < addrs[j].Hex() })
+	return addrs
+}
+
+func TestModifiedAccountsDiff(t *testing.T) {
+	db := NewMemDatabase()
+	addrs := make([]common.Address, 5)
+	for i := range addrs {
+		addrs[i] = common.BytesToAddress([]byte{byte(i + 1)})
+	}
+	// Accounts modified at each block
+	modified := map[uint64][]int{
+		1: {0, 1},
+		2: {2},
+		3: {1, 3},
+		4: {4},
+	}
+	for blockNr, idxs := range modified {
+		for _, i := range idxs {
+			// Key is a stand-in for the hash of the address, resolved via the preimage
+			key := common.BytesToHash(append([]byte{0xaa}, addrs[i][:]...))
+			if err := db.Put([]byte("secure-key-"), key[:], addrs[i][:]); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.PutS([]byte("hAT"), key[:], []byte{byte(blockNr)}, blockNr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	onlyA, onlyB, both, err := ModifiedAccountsDiff(db, [2]uint64{1, 2}, [2]uint64{3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []common.Address{addrs[0], addrs[2]}; !reflect.DeepEqual(sortedAddresses(onlyA), exp) {
+		t.Errorf("onlyA: got %x, expected %x", onlyA, exp)
+	}
+	if exp := []common.Address{addrs[3], addrs[4]}; !reflect.DeepEqual(sortedAddresses(onlyB), exp) {
+		t.Errorf("onlyB: got %x, expected %x", onlyB, exp)
+	}
+	if exp := []common.Address{addrs[1]}; !reflect.DeepEqual(both, exp) {
+		t.Errorf("both: got %x, expected %x", both, exp)
+	}
+}
+
+func TestChangedKeysInBlock(t *testing.T) {
+	db := NewMemDatabase()
+	keys := [][]byte{
+		common.HexToHash("0x01").Bytes(),
+		common.HexToHash("0x02").Bytes(),
+		common.HexToHash("0x03").Bytes(),
+	}
+	for _, change := range []struct {
+		hBucket []byte
+		key     []byte
+		blockNr uint64
+	}{
+		{[]byte("hAT"), keys[0], 1},
+		{[]byte("hAT"), keys[1], 2},
+		{[]byte("hAT"), keys[2], 2},
+		{[]byte("hST"), keys[0], 2},
+		{[]byte("hAT"), keys[0], 3},
+	} {
+		if err := db.PutS(change.hBucket, change.key, []byte{1}, change.blockNr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		bucket   []byte
+		blockNr  uint64
+		expected [][]byte
+	}{
+		{[]byte("AT"), 1, [][]byte{keys[0]}},
+		{[]byte("AT"), 2, [][]byte{keys[1], keys[2]}},
+		{[]byte("ST"), 2, [][]byte{keys[0]}},
+		{[]byte("AT"), 3, [][]byte{keys[0]}},
+		{[]byte("AT"), 4, nil},
+		{[]byte("ST"), 1, nil},
+	} {
+		changed, err := ChangedKeysInBlock(db, test.bucket, test.blockNr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(changed, test.expected) {
+			t.Errorf("bucket %s, block %d: got %x, expected %x", test.bucket, test.blockNr, changed, test.expected)
+		}
+	}
+	if _, err := ChangedKeysInBlock(db, []byte("hAT"), 1); err == nil {
+		t.Errorf("expected an error for a history bucket")
+	}
+}
+
+func TestVerifyAsOfAtHead(t *testing.T) {
+	db := NewMemDatabase()
+	bucket, hBucket := []byte("AT"), []byte("hAT")
+	keys := [][]byte{
+		common.HexToHash("0x01").Bytes(),
+		common.HexToHash("0x02").Bytes(),
+		common.HexToHash("0x03").Bytes(),
+		common.HexToHash("0x04").Bytes(), // Never written
+	}
+	// Key 1 changed at block 1 and 3, key 2 at block 2, key 3 created and deleted at block 3
+	for _, change := range []struct {
+		key          []byte
+		before, live []byte
+		blockNr      uint64
+	}{
+		{keys[0], nil, []byte{1}, 1},
+		{keys[1], nil, []byte{2}, 2},
+		{keys[0], []byte{1}, []byte{3}, 3},
+		{keys[2], []byte{4}, nil, 3},
+	} {
+		if err := db.PutS(hBucket, change.key, change.before, change.blockNr); err != nil {
+			t.Fatal(err)
+		}
+		if change.live == nil {
+			db.Delete(bucket, change.key)
+		} else if err := db.Put(bucket, change.key, change.live); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mismatched, err := VerifyAsOfAtHead(db, bucket, hBucket, 3, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatched) != 0 {
+		t.Errorf("unexpected mismatches for consistent data: %x", mismatched)
+	}
+	// Stale history entry from a block after the head, e.g. not removed by an unwind
+	if err := db.PutS(hBucket, keys[1], []byte{5}, 4); err != nil {
+		t.Fatal(err)
+	}
+	mismatched, err = VerifyAsOfAtHead(db, bucket, hBucket, 3, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []common.Hash{common.BytesToHash(keys[1])}; !reflect.DeepEqual(mismatched, exp) {
+		t.Errorf("mismatches: got %x, expected %x", mismatched, exp)
+	}
+}
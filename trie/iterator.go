@@ -114,7 +114,7 @@ type nodeIteratorState struct {
 }
 
 type nodeIterator struct {
-	db      ethdb.Database
+	db      ethdb.Getter
 	trie    *Trie                // Trie being iterated
 	stack   []*nodeIteratorState // Hierarchy of trie nodes persisting the iteration state
 	path    []byte               // Path to the current node
@@ -135,7 +135,7 @@ func (e seekError) Error() string {
 	return "seek error: " + e.err.Error()
 }
 
-func newNodeIterator(db ethdb.Database, trie *Trie, start []byte, blockNr uint64) NodeIterator {
+func newNodeIterator(db ethdb.Getter, trie *Trie, start []byte, blockNr uint64) NodeIterator {
 	if trie.Hash() == emptyState {
 		return new(nodeIterator)
 	}
@@ -300,7 +300,7 @@ func (it *nodeIterator) peek(descend bool) (*nodeIteratorState, *int, []byte, er
 	return nil, nil, nil, errIteratorEnd
 }
 
-func (st *nodeIteratorState) resolve(db ethdb.Database, tr *Trie, path []byte, blockNr uint64) error {
+func (st *nodeIteratorState) resolve(db ethdb.Getter, tr *Trie, path []byte, blockNr uint64) error {
 	if hash, ok := st.node.(hashNode); ok {
 		resolved, err := tr.resolveHash(db, hash, path, len(path), blockNr)
 		if err != nil {
@@ -24,7 +24,6 @@ import (
 	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
-	"github.com/ledgerwatch/turbo-geth/rlp"
 )
 
 // Prove constructs a merkle proof for key. The result contains all encoded nodes
@@ -35,7 +34,32 @@ import (
 // nodes of the longest existing prefix of the key (at least the root node), ending
 // with the node that proves the absence of the key.
 func (t *Trie) Prove(db ethdb.Database, key []byte, fromLevel uint, proofDb ethdb.Putter, blockNr uint64) error {
-	// Collect all nodes on the path to key.
+	nodes, err := t.proofPath(db, key, blockNr)
+	if err != nil {
+		return err
+	}
+	forEachProofElement(nodes, fromLevel, func(hash, enc []byte) {
+		proofDb.Put([]byte("b"), hash, enc)
+	})
+	return nil
+}
+
+// ProofSize returns the number of nodes and their total encoded size in bytes in
+// the proof that Prove would construct for key, without storing the proof.
+func (t *Trie) ProofSize(db ethdb.Database, key []byte, blockNr uint64) (nodes int, bytes int, err error) {
+	path, err := t.proofPath(db, key, blockNr)
+	if err != nil {
+		return 0, 0, err
+	}
+	forEachProofElement(path, 0, func(hash, enc []byte) {
+		nodes++
+		bytes += len(enc)
+	})
+	return nodes, bytes, nil
+}
+
+// proofPath collects all nodes on the path to key, resolving them if necessary.
+func (t *Trie) proofPath(db ethdb.Database, key []byte, blockNr uint64) ([]node, error) {
 	key = keybytesToHex(key)
 	pos := 0
 	nodes := []node{}
@@ -72,12 +96,18 @@ func (t *Trie) Prove(db ethdb.Database, key []byte, fromLevel uint, proofDb ethd
 			tn, err = t.resolveHash(db, n, key, pos, blockNr)
 			if err != nil {
 				log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
-				return err
+				return nil, err
 			}
 		default:
 			panic(fmt.Sprintf("%T: invalid node: %v", tn, tn))
 		}
 	}
+	return nodes, nil
+}
+
+// forEachProofElement calls f with the hash and the encoding of each of the nodes
+// on the path that become proof elements, skipping the first fromLevel of them.
+func forEachProofElement(nodes []node, fromLevel uint, f func(hash, enc []byte)) {
 	hasher := newHasher(false)
 	defer returnHasherToPool(hasher)
 	for i, n := range nodes {
@@ -93,15 +123,15 @@ func (t *Trie) Prove(db ethdb.Database, key []byte, fromLevel uint, proofDb ethd
 			if fromLevel > 0 {
 				fromLevel--
 			} else {
-				enc, _ := rlp.EncodeToBytes(hash)
+				// hashChildren returns the encoding of the node itself
+				enc := common.CopyBytes(ch)
 				if hashLen < 32 {
 					hash = crypto.Keccak256(enc)
 				}
-				proofDb.Put([]byte("b"), hash, enc)
+				f(hash, enc)
 			}
 		}
 	}
-	return nil
 }
 
 // Prove constructs a merkle proof for key. The result contains all encoded nodes
@@ -126,7 +156,7 @@ func VerifyProof(rootHash common.Hash, key []byte, proofDb DatabaseReader) (valu
 		if buf == nil {
 			return nil, i, fmt.Errorf("proof node %d (hash %064x) missing", i, wantHash)
 		}
-		n, _, err := decodeRef(buf)
+		n, err := decodeNode(wantHash[:], buf)
 		if err != nil {
 			return nil, i, fmt.Errorf("bad proof node %d (%x): %v", i, buf, err)
 		}
@@ -144,6 +174,19 @@ func VerifyProof(rootHash common.Hash, key []byte, proofDb DatabaseReader) (valu
 	}
 }
 
+// VerifyProofWithPreimage checks a merkle proof for a key of a secure trie given
+// in its plain (not hashed) form. The key is hashed before the proof is verified,
+// so that the callers cannot accidentally prove the plain key itself. If the proof
+// database also contains the preimage of the hashed key, it has to match plainKey.
+func VerifyProofWithPreimage(rootHash common.Hash, plainKey []byte, proofDb ethdb.Database) (value []byte, err error) {
+	hashedKey := crypto.Keccak256(plainKey)
+	if preimage, _ := proofDb.Get(SecureKeyPrefix, hashedKey); preimage != nil && !bytes.Equal(preimage, plainKey) {
+		return nil, fmt.Errorf("preimage mismatch for key %x: proof contains %x", hashedKey, preimage)
+	}
+	value, _, err = VerifyProof(rootHash, hashedKey, proofDb)
+	return value, err
+}
+
 func get(tn node, key []byte) ([]byte, node) {
 	for {
 		switch n := tn.(type) {
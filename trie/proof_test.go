@@ -18,8 +18,8 @@ package trie
 
 import (
 	"bytes"
-	//"fmt"
 	crand "crypto/rand"
+	"fmt"
 	mrand "math/rand"
 	"testing"
 	"time"
@@ -158,6 +158,81 @@ func mutateByte(b []byte) {
 	}
 }
 
+func TestVerifyProofWithPreimage(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	st, err := NewSecure(common.Hash{}, testbucket, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(0); i < 100; i++ {
+		slot := common.BytesToHash([]byte{i})
+		st.Update(db, slot[:], []byte{i + 1}, 0)
+	}
+	root := st.Hash()
+	slot := common.BytesToHash([]byte{42})
+	proof := ethdb.NewMemDatabase()
+	if err = st.Prove(db, st.HashKey(slot[:]), 0, proof, 0); err != nil {
+		t.Fatal(err)
+	}
+	val, err := VerifyProofWithPreimage(root, slot[:], proof)
+	if err != nil {
+		t.Fatalf("failed to verify proof: %v", err)
+	}
+	if !bytes.Equal(val, []byte{43}) {
+		t.Errorf("verified value mismatch: have %x, want %x", val, []byte{43})
+	}
+	// Proving the hashed key as if it were the plain key must not yield the value
+	if val, _ := VerifyProofWithPreimage(root, st.HashKey(slot[:]), proof); val != nil {
+		t.Errorf("expected no value for the hashed key, got %x", val)
+	}
+	// Preimage supplied together with the proof has to match
+	if err = proof.Put(SecureKeyPrefix, st.HashKey(slot[:]), slot[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = VerifyProofWithPreimage(root, slot[:], proof); err != nil {
+		t.Fatalf("failed to verify proof with preimage: %v", err)
+	}
+	if err = proof.Put(SecureKeyPrefix, st.HashKey(slot[:]), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = VerifyProofWithPreimage(root, slot[:], proof); err == nil {
+		t.Errorf("expected preimage mismatch error")
+	}
+}
+
+func TestProofSize(t *testing.T) {
+	trie, vals := randomTrie(500)
+	trie.Hash()
+	keys := [][]byte{randBytes(32), []byte("k")}
+	for _, kv := range vals {
+		keys = append(keys, kv.k)
+		if len(keys) == 50 {
+			break
+		}
+	}
+	for _, key := range keys {
+		proof := ethdb.NewMemDatabase()
+		if err := trie.Prove(proof, key, 0, proof, 0); err != nil {
+			t.Fatal(err)
+		}
+		var expectedNodes, expectedBytes int
+		if err := proof.Walk([]byte("b"), nil, 0, func(k, v []byte) (bool, error) {
+			expectedNodes++
+			expectedBytes += len(v)
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		nodes, size, err := trie.ProofSize(proof, key, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodes != expectedNodes || size != expectedBytes {
+			t.Errorf("key %x: got %d nodes of %d bytes, proof has %d nodes of %d bytes", key, nodes, size, expectedNodes, expectedBytes)
+		}
+	}
+}
+
 func benchmarkProve(b *testing.B) {
 	trie, vals := randomTrie(100)
 	var keys []string
@@ -223,3 +298,46 @@ func randBytes(n int) []byte {
 	crand.Read(r)
 	return r
 }
+
+// Tests that the proof elements are the encodings of the nodes keyed by their
+// hashes, so that the proofs written by Prove can be verified.
+func TestProveNodeEncodings(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	trie := New(common.Hash{}, testbucket, nil, false)
+	var vals []*kv
+	for i := byte(0); i < 100; i++ {
+		value := &kv{crypto.Keccak256([]byte{i}), []byte{i + 1}, false}
+		trie.Update(db, value.k, value.v, 0)
+		vals = append(vals, value)
+	}
+	root := trie.Hash()
+	for _, kv := range vals {
+		proof := ethdb.NewMemDatabase()
+		if err := trie.Prove(db, kv.k, 0, proof, 0); err != nil {
+			t.Fatalf("prove %x: %v", kv.k, err)
+		}
+		elements := 0
+		if err := proof.Walk([]byte("b"), nil, 0, func(k, v []byte) (bool, error) {
+			if !bytes.Equal(crypto.Keccak256(v), k) {
+				return false, fmt.Errorf("proof element %x is not keyed by its hash %x", v, k)
+			}
+			if _, err := decodeNode(k, v); err != nil {
+				return false, fmt.Errorf("proof element %x is not a node encoding: %v", v, err)
+			}
+			elements++
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if elements == 0 {
+			t.Fatalf("empty proof for %x", kv.k)
+		}
+		val, _, err := VerifyProof(root, kv.k, proof)
+		if err != nil {
+			t.Fatalf("proof of %x does not verify: %v", kv.k, err)
+		}
+		if !bytes.Equal(val, kv.v) {
+			t.Fatalf("proof of %x verified wrong value %x, want %x", kv.k, val, kv.v)
+		}
+	}
+}
@@ -39,6 +39,101 @@ func (t *Trie) Rebuild(db ethdb.Database, blockNr uint64) hashNode {
 	return roothash
 }
 
+// IntermediateHashesBucket holds the hashes of the subtries computed by RebuildFlushing,
+// keyed by the nibble paths (one nibble per byte) of the roots of the subtries.
+// It is a write-only cache for the external tools, nothing in the trie reads it.
+// RebuildFlushing clears it before writing, so after a successful rebuild it
+// describes the rebuilt trie only.
+var IntermediateHashesBucket = []byte("iH")
+
+// flushLevel is the level of the subtries whose hashes RebuildFlushing writes into
+// the IntermediateHashesBucket
+const flushLevel = 3
+
+// RebuildFlushing is a variant of Rebuild for the tries too large to be rebuilt in
+// one go. The trie is rebuilt one subtrie of the root at a time. The hashes of the
+// completed subtries at the flushLevel are written into the IntermediateHashesBucket
+// of the batch, which is committed between the subtries according to its flush policy,
+// so that only the spine of the trie stays resident in memory. While the rebuild is in
+// progress, the root of the trie is the partially rebuilt spine.
+func (t *Trie) RebuildFlushing(db ethdb.Database, batch ethdb.Mutation, blockNr uint64) (_ hashNode, err error) {
+	if t.root == nil {
+		return nil, nil
+	}
+	n, ok := t.root.(hashNode)
+	if !ok {
+		return nil, fmt.Errorf("expected hashNode, got %T", t.root)
+	}
+	// Hashes left from the previous rebuilds may belong to subtries that no longer exist
+	if err := db.Walk(IntermediateHashesBucket, nil, 0, func(k, _ []byte) (bool, error) {
+		return true, batch.Delete(IntermediateHashesBucket, k)
+	}); err != nil {
+		return nil, err
+	}
+	var full fullNode
+	full.flags.dirty = true
+	t.root = &full
+	defer func() {
+		if err != nil {
+			t.root = n
+		}
+	}()
+	fillCount := 0
+	var last byte
+	for nibble := byte(0); nibble < 16; nibble++ {
+		tc := t.NewContinuation([]byte{nibble}, 1, nil)
+		r := NewResolver(nil, false, t.accounts)
+		r.SetHistorical(t.historical)
+		r.flush = batch
+		r.AddContinuation(tc)
+		if err := r.ResolveWithDb(db, blockNr); err != nil {
+			return nil, err
+		}
+		if tc.resolved == nil {
+			continue
+		}
+		full.Children[nibble] = tc.resolved
+		fillCount++
+		last = nibble
+		// Nothing is read from the database between the subtries, so it is safe to write
+		if _, err := batch.CommitIfNeeded(); err != nil {
+			return nil, err
+		}
+	}
+	var root node
+	switch fillCount {
+	case 0:
+	case 1:
+		// Single subtrie becomes the root, extended by its nibble
+		short := &shortNode{Key: hexToCompact([]byte{last}), Val: full.Children[last]}
+		if child, ok := full.Children[last].(*shortNode); ok {
+			short.Key = hexToCompact(append([]byte{last}, compactToHex(child.Key)...))
+			short.Val = child.Val
+		}
+		short.flags.dirty = true
+		root = short
+	case 2:
+		root = full.duoCopy()
+	default:
+		root = full.copy()
+	}
+	roothash := hashNode(emptyRoot[:])
+	if root != nil {
+		h := newHasher(t.encodeToBytes)
+		defer returnHasherToPool(h)
+		var hash common.Hash
+		h.hash(root, true, hash[:])
+		roothash = hash[:]
+	}
+	if !bytes.Equal(roothash, n) {
+		return nil, fmt.Errorf("could not rebuild %s vs %s", roothash, n)
+	}
+	t.root = root
+	log.Info("Rebuilt hashfile with flushing and verified", "root hash", roothash)
+	t.timestampSubTree(t.root, blockNr)
+	return roothash, nil
+}
+
 const Levels = 104
 
 type ResolveHexes [][]byte
@@ -79,6 +174,7 @@ type TrieResolver struct {
 	keyIdx      int
 	h           *hasher
 	historical  bool
+	flush       ethdb.Putter // If set, hashes of the subtries at the flushLevel are written into it
 }
 
 func NewResolver(dbw ethdb.Putter, hashes bool, accounts bool) *TrieResolver {
@@ -302,6 +398,10 @@ func (tr *TrieResolver) finishPreviousKey(k []byte) error {
 	for level := startLevel; level >= stopLevel; level-- {
 		keynibble := hex[level]
 		onResolvingPath := level <= rhPrefixLen // <= instead of < to be able to resolve deletes in one go
+		if tr.flush != nil {
+			// Flushing rebuild only keeps the roots of the subtries it resolves
+			onResolvingPath = level < rhPrefixLen
+		}
 		if tr.fillCount[level+1] == 1 {
 			// Short node, needs to be promoted to the level above
 			short := &tr.nodeStack[level+1]
@@ -337,6 +437,11 @@ func (tr *TrieResolver) finishPreviousKey(k []byte) error {
 			tr.nodeStack[level].flags.dirty = true
 		}
 		tr.vertical[level].flags.dirty = true
+		if tr.flush != nil && level == 2*len(tc.t.prefix)+flushLevel {
+			if err := tr.flush.Put(IntermediateHashesBucket, common.CopyBytes(hex[:level+1]), common.CopyBytes(storeHashTo[:])); err != nil {
+				return err
+			}
+		}
 		if onResolvingPath || (tr.hashes && level == 5) {
 			var c node
 			if tr.fillCount[level+1] == 2 {
@@ -383,7 +488,8 @@ func (tr *TrieResolver) finishPreviousKey(k []byte) error {
 		var gotHash common.Hash
 		hashLen := tr.h.hash(root, tc.resolvePos == 0, gotHash[:])
 		if hashLen == 32 {
-			if !bytes.Equal(tc.resolveHash, gotHash[:]) {
+			// Continuations without the expected hash only compute it
+			if tc.resolveHash != nil && !bytes.Equal(tc.resolveHash, gotHash[:]) {
 				return fmt.Errorf("Resolving wrong hash for prefix %x, key %x, pos %d, \nexpected %s, got %s\n",
 					tc.t.prefix,
 					tc.resolveKey,
@@ -487,7 +593,7 @@ func (tr *TrieResolver) Walker(keyIdx int, k []byte, v []byte) (bool, error) {
 	return true, nil
 }
 
-func (tr *TrieResolver) ResolveWithDb(db ethdb.Database, blockNr uint64) error {
+func (tr *TrieResolver) ResolveWithDb(db ethdb.Getter, blockNr uint64) error {
 	tr.h = newHasher(!tr.accounts)
 	defer returnHasherToPool(tr.h)
 	startkeys, fixedbits := tr.PrepareResolveParams()
@@ -516,9 +622,9 @@ func (tr *TrieResolver) ResolveWithDb(db ethdb.Database, blockNr uint64) error {
 	return err
 }
 
-func (t *Trie) rebuildHashes(db ethdb.Database, key []byte, pos int, blockNr uint64, accounts bool, expected hashNode) (node, hashNode, error) {
+func (t *Trie) rebuildHashes(db ethdb.Getter, key []byte, pos int, blockNr uint64, accounts bool, expected hashNode) (node, hashNode, error) {
 	tc := t.NewContinuation(key, pos, expected)
-	r := NewResolver(db, true, accounts)
+	r := NewResolver(nil, true, accounts)
 	r.SetHistorical(t.historical)
 	r.AddContinuation(tc)
 	if err := r.ResolveWithDb(db, blockNr); err != nil {
@@ -526,3 +632,24 @@ func (t *Trie) rebuildHashes(db ethdb.Database, key []byte, pos int, blockNr uin
 	}
 	return tc.resolved, expected, nil
 }
+
+// ResolveRootHash walks the keys of the trie in the database and returns the hash
+// of its root. Only the root node is reconstructed, the nodes below it are
+// replaced by their hashes as soon as they are complete.
+func (t *Trie) ResolveRootHash(db ethdb.Getter, blockNr uint64) (common.Hash, error) {
+	tc := t.NewContinuation(nil, 0, nil)
+	r := NewResolver(nil, false, t.accounts)
+	r.SetHistorical(t.historical)
+	r.AddContinuation(tc)
+	if err := r.ResolveWithDb(db, blockNr); err != nil {
+		return common.Hash{}, err
+	}
+	if tc.resolved == nil {
+		return emptyRoot, nil
+	}
+	h := newHasher(t.encodeToBytes)
+	defer returnHasherToPool(h)
+	var root common.Hash
+	h.hash(tc.resolved, true, root[:])
+	return root, nil
+}
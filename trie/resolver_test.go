@@ -2,10 +2,12 @@ package trie
 
 import (
 	"bytes"
+	"math/big"
 	//"fmt"
 	"testing"
 
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/rlp"
 )
@@ -225,3 +227,63 @@ func TestTrieResolver(t *testing.T) {
 	}
 	//t.Errorf("TestTrieResolver resolved:\n%s\n", tc3.resolved.fstring(""))
 }
+
+// Resolver of the flushing rebuild keeps only the root of the resolved subtrie,
+// with the hashes of its children, and writes the intermediate hashes
+func TestResolveFlushing(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	for i := 0; i < 5000; i++ {
+		v, err := rlp.EncodeToBytes(&ExtAccount{Nonce: uint64(i), Balance: big.NewInt(int64(i + 1))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Put([]byte("AT"), crypto.Keccak256([]byte{byte(i >> 8), byte(i)}), v)
+	}
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+	var hashes [2]common.Hash
+	for j, flush := range []bool{false, true} {
+		tc := New(common.Hash{}, []byte("AT"), nil, true).NewContinuation([]byte{5}, 1, nil)
+		batch := db.NewBatch()
+		r := NewResolver(nil, false, true)
+		if flush {
+			r.flush = batch
+		}
+		r.AddContinuation(tc)
+		if err := r.ResolveWithDb(db, 0); err != nil {
+			t.Fatal(err)
+		}
+		resolved, ok := tc.resolved.(*fullNode)
+		if !ok {
+			t.Fatalf("flush %t: expected fullNode, got %T", flush, tc.resolved)
+		}
+		h.hash(resolved, true, hashes[j][:])
+		for i, child := range resolved.Children {
+			if child == nil {
+				continue
+			}
+			if _, isHash := child.(hashNode); isHash != flush {
+				t.Errorf("flush %t: child %x is %T", flush, i, child)
+			}
+		}
+		if _, err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		flushed := 0
+		if err := db.Walk(IntermediateHashesBucket, nil, 0, func(k, v []byte) (bool, error) {
+			if len(k) != flushLevel+1 || k[0] != 5 || len(v) != common.HashLength {
+				t.Errorf("flush %t: unexpected intermediate hash %x for %x", flush, v, k)
+			}
+			flushed++
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if flush != (flushed > 0) {
+			t.Errorf("flush %t: %d intermediate hashes written", flush, flushed)
+		}
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("flushing resolver computed %x, expected %x", hashes[1], hashes[0])
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// rootHasherFrame is a branch node that is still being built. It is located at the
+// nibble depth of the key, and its children are indexed by the nibble key[depth]
+type rootHasherFrame struct {
+	depth    int
+	key      []byte // Nibbles of one of the keys below the branch
+	children [17]node
+}
+
+// RootHasher computes the root hash of the account trie from the accounts supplied
+// in the order of their secure keys. Only the branches on the path of the latest
+// account are kept in memory, all the other nodes are replaced by their hashes as
+// soon as they are complete, so the memory used does not depend on the number of
+// accounts. Storage tries are hashed the same way, with the RLP encodings of the
+// storage values in place of the accounts.
+type RootHasher struct {
+	h         *hasher
+	stack     []*rootHasherFrame
+	prevKey   []byte // Nibbles of the previous key, nil if there was none
+	prevValue []byte
+}
+
+// NewRootHasher creates a hasher for an empty trie. Finalize must be called to
+// release the resources of the hasher.
+func NewRootHasher() *RootHasher {
+	return &RootHasher{h: newHasher(false)}
+}
+
+// Add supplies the next account. Secure keys must be strictly increasing.
+func (rh *RootHasher) Add(secKey []byte, accountRLP []byte) error {
+	if len(secKey) != common.HashLength {
+		return fmt.Errorf("secure key %x must be %d bytes long", secKey, common.HashLength)
+	}
+	key := keybytesToHex(secKey)
+	if rh.prevKey != nil {
+		if bytes.Compare(rh.prevKey, key) >= 0 {
+			return fmt.Errorf("secure key %x is not greater than the previous one", secKey)
+		}
+		rh.addPrevious(prefixLen(rh.prevKey, key))
+	}
+	rh.prevKey = key
+	rh.prevValue = common.CopyBytes(accountRLP)
+	return nil
+}
+
+// Finalize returns the root hash of all the accounts added so far. The hasher must
+// not be used after that.
+func (rh *RootHasher) Finalize() (common.Hash, error) {
+	defer returnHasherToPool(rh.h)
+	if rh.prevKey == nil {
+		return emptyRoot, nil
+	}
+	rh.addPrevious(-1)
+	var root common.Hash
+	rh.h.hash(rh.stack[0].children[0], true, root[:])
+	return root, nil
+}
+
+// addPrevious attaches the previous key to the trie, and completes all the
+// branches that are deeper than cp, the length of the common prefix of the
+// previous and the next keys (-1 if there is no next key).
+func (rh *RootHasher) addPrevious(cp int) {
+	if len(rh.stack) == 0 || rh.stack[len(rh.stack)-1].depth < cp {
+		rh.stack = append(rh.stack, &rootHasherFrame{depth: cp, key: rh.prevKey})
+	}
+	top := rh.stack[len(rh.stack)-1]
+	leaf := &shortNode{Key: hexToCompact(rh.prevKey[top.depth+1:]), Val: valueNode(rh.prevValue)}
+	leaf.flags.dirty = true
+	top.children[top.childIndex(rh.prevKey)] = rh.ref(leaf)
+	for top.depth > cp {
+		rh.stack = rh.stack[:len(rh.stack)-1]
+		if len(rh.stack) == 0 || rh.stack[len(rh.stack)-1].depth < cp {
+			rh.stack = append(rh.stack, &rootHasherFrame{depth: cp, key: top.key})
+		}
+		parent := rh.stack[len(rh.stack)-1]
+		parent.children[parent.childIndex(top.key)] = rh.ref(top.node(parent.depth + 1))
+		top = parent
+	}
+}
+
+// ref returns the reference to the complete node n from its parent: the node
+// itself if its encoding is shorter than a hash, its hash otherwise
+func (rh *RootHasher) ref(n node) node {
+	var hash common.Hash
+	if rh.h.hash(n, false, hash[:]) == common.HashLength {
+		return hashNode(hash[:])
+	}
+	return n
+}
+
+// childIndex returns the position of the key among the children of the branch.
+// The frame at depth -1 only holds the root, under the child 0
+func (f *rootHasherFrame) childIndex(key []byte) byte {
+	if f.depth < 0 {
+		return 0
+	}
+	return key[f.depth]
+}
+
+// node returns the complete branch, below the extension node if the branch is
+// not immediately below the nibble at position from
+func (f *rootHasherFrame) node(from int) node {
+	full := &fullNode{Children: f.children}
+	full.flags.dirty = true
+	if from == f.depth {
+		return full
+	}
+	short := &shortNode{Key: hexToCompact(f.key[from:f.depth]), Val: full}
+	short.flags.dirty = true
+	return short
+}
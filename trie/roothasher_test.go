@@ -0,0 +1,80 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+)
+
+func TestRootHasher(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 17, 100, 1000} {
+		tr := New(common.Hash{}, testbucket, nil, false)
+		var keys [][]byte
+		values := make(map[string][]byte)
+		for i := 0; i < n; i++ {
+			addr := common.BigToAddress(big.NewInt(int64(i)))
+			account := Account{
+				Nonce:    uint64(i),
+				Balance:  big.NewInt(int64(i * 1000)),
+				Root:     emptyRoot,
+				CodeHash: emptyCodeHash,
+			}
+			enc, err := rlp.EncodeToBytes(&account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secKey := crypto.Keccak256(addr[:])
+			tr.Update(nil, secKey, enc, 0)
+			keys = append(keys, secKey)
+			values[string(secKey)] = enc
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+		rh := NewRootHasher()
+		for _, key := range keys {
+			if err := rh.Add(key, values[string(key)]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root, err := rh.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != tr.Hash() {
+			t.Errorf("%d accounts: root %x, expected %x", n, root, tr.Hash())
+		}
+	}
+}
+
+func TestRootHasherOrder(t *testing.T) {
+	rh := NewRootHasher()
+	if err := rh.Add(common.HexToHash("0x02").Bytes(), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rh.Add(common.HexToHash("0x01").Bytes(), []byte{1}); err == nil {
+		t.Errorf("expected an error for a key out of order")
+	}
+	if err := rh.Add(common.HexToHash("0x02").Bytes(), []byte{1}); err == nil {
+		t.Errorf("expected an error for a repeated key")
+	}
+}
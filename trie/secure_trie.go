@@ -151,7 +151,7 @@ func (t *SecureTrie) Copy() *SecureTrie {
 
 // NodeIterator returns an iterator that returns nodes of the underlying trie. Iteration
 // starts at the key after the given start key.
-func (t *SecureTrie) NodeIterator(db ethdb.Database, start []byte, blockNr uint64) NodeIterator {
+func (t *SecureTrie) NodeIterator(db ethdb.Getter, start []byte, blockNr uint64) NodeIterator {
 	return t.trie.NodeIterator(db, start, blockNr)
 }
 
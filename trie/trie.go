@@ -692,8 +692,8 @@ func (t *Trie) AsProof(trace bool) (
 
 func (t *Trie) SetHistorical(h bool) {
 	t.historical = h
-	if h && !bytes.HasPrefix(t.bucket, []byte("h")) {
-		t.bucket = append([]byte("h"), t.bucket...)
+	if h && ethdb.BucketFromHistory(t.bucket) == nil {
+		t.bucket = ethdb.HistoryBucket(t.bucket)
 	}
 }
 
@@ -724,7 +724,7 @@ func (t *Trie) ProofFunctions(
 
 // NodeIterator returns an iterator that returns nodes of the trie. Iteration starts at
 // the key after the given start key.
-func (t *Trie) NodeIterator(db ethdb.Database, start []byte, blockNr uint64) NodeIterator {
+func (t *Trie) NodeIterator(db ethdb.Getter, start []byte, blockNr uint64) NodeIterator {
 	return newNodeIterator(db, t, start, blockNr)
 }
 
@@ -755,7 +755,8 @@ func (t *Trie) TryGet(db ethdb.Database, key []byte, blockNr uint64) (value []by
 
 func (t *Trie) tryGet(dbr DatabaseReader, origNode node, key []byte, pos int, blockNr uint64) (value []byte, err error) {
 	if t.historical {
-		value, err = dbr.GetAsOf(t.bucket[1:], t.bucket, append(t.prefix, key...), blockNr)
+		// Same as in the resolver, the state after the block blockNr is read as of blockNr+1
+		value, err = dbr.GetAsOf(ethdb.BucketFromHistory(t.bucket), t.bucket, append(t.prefix, key...), blockNr+1)
 	} else {
 		value, err = dbr.Get(t.bucket, append(t.prefix, key...))
 	}
@@ -949,7 +950,11 @@ func loadNode(br *bufio.Reader) (node, error) {
 	if err != nil {
 		return nil, err
 	}
-	switch nodeType[len(nodeType)-2:] {
+	return loadNodeOfType(br, nodeType[len(nodeType)-2:])
+}
+
+func loadNodeOfType(br *bufio.Reader, nodeType string) (node, error) {
+	switch nodeType {
 	case "f(":
 		return loadFull(br)
 	case "d(":
@@ -1080,12 +1085,44 @@ func loadValue(br *bufio.Reader) (valueNode, error) {
 	return valueNode(val), nil
 }
 
+// Load reads the trie written by Print, so that loading the output of Print
+// and printing the loaded trie again produces the same output
 func Load(r io.Reader, encodeToBytes bool) (*Trie, error) {
 	br := bufio.NewReader(r)
 	t := new(Trie)
 	t.encodeToBytes = encodeToBytes
+	// Print writes the prefix followed by ':' (if the prefix is set), then
+	// the root node (if the trie is not empty), then the new line
+	var head []byte
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF || c == '\n' {
+			if len(head) > 0 {
+				return nil, fmt.Errorf("unexpected trie header: %s", head)
+			}
+			if err == nil {
+				br.UnreadByte()
+			}
+			// Empty trie
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c == ':' && t.prefix == nil {
+			if t.prefix, err = hex.DecodeString(string(head)); err != nil {
+				return nil, err
+			}
+			head = head[:0]
+			continue
+		}
+		head = append(head, c)
+		if c == '(' {
+			break
+		}
+	}
 	var err error
-	t.root, err = loadNode(br)
+	t.root, err = loadNodeOfType(br, string(head))
 	return t, err
 }
 
@@ -1904,7 +1941,7 @@ func concat(s1 []byte, s2 ...byte) []byte {
 	return r
 }
 
-func (t *Trie) resolveHash(db ethdb.Database, n hashNode, key []byte, pos int, blockNr uint64) (node, error) {
+func (t *Trie) resolveHash(db ethdb.Getter, n hashNode, key []byte, pos int, blockNr uint64) (node, error) {
 	root, gotHash, err := t.rebuildHashes(db, key, pos, blockNr, t.accounts, n)
 	if err != nil {
 		return nil, err
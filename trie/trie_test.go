@@ -278,6 +278,38 @@ func TestLargeValue(t *testing.T) {
 	trie.Hash()
 }
 
+// printTrie returns the dump of the trie in the format read by Load
+func printTrie(t *Trie) string {
+	var buf bytes.Buffer
+	t.Print(&buf)
+	return buf.String()
+}
+
+func TestLoadPrintRoundTrip(t *testing.T) {
+	withPrefix, _ := randomTrie(500)
+	noPrefix, _ := randomTrie(200)
+	noPrefix.prefix = nil
+	_, empty := newEmpty()
+	_, emptyWithPrefix := newEmpty()
+	emptyWithPrefix.prefix = testbucket
+	for i, tr := range []*Trie{withPrefix, noPrefix, empty, emptyWithPrefix} {
+		dump := printTrie(tr)
+		loaded, err := Load(bytes.NewBufferString(dump), false)
+		if err != nil {
+			t.Fatalf("trie %d: load failed: %v", i, err)
+		}
+		if dump2 := printTrie(loaded); dump2 != dump {
+			t.Errorf("trie %d: dump differs after load\nbefore: %s\nafter:  %s", i, dump, dump2)
+		}
+		if !bytes.Equal(loaded.prefix, tr.prefix) {
+			t.Errorf("trie %d: prefix %x, expected %x", i, loaded.prefix, tr.prefix)
+		}
+		if h1, h2 := tr.Hash(), loaded.Hash(); h1 != h2 {
+			t.Errorf("trie %d: root %x, expected %x", i, h2, h1)
+		}
+	}
+}
+
 type countingDB struct {
 	ethdb.Database
 	gets map[string]int